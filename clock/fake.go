@@ -0,0 +1,155 @@
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only moves when it is advanced, firing the timers that fall due in deadline order.
+// Timers are delivered as by the time package: channel timers hold at most one undelivered time,
+// and AfterFunc timers call their function in its own goroutine.
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+	// timers holds the pending timers, ordered by deadline and then by creation.
+	timers []*fakeTimer
+	// changed is closed and replaced whenever a timer is added, so that BlockUntil can wait for it.
+	changed chan struct{}
+}
+
+// NewFake returns a Fake clock that starts at now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now:     now,
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: f,
+		c:     make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	t := &fakeTimer{
+		clock: f,
+		fn:    fn,
+	}
+	t.Reset(d)
+	return t
+}
+
+// Sleep blocks until the clock has been advanced by d.
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d, firing every timer whose deadline is reached.
+// Timers fire in deadline order, and the clock reads their deadline while they do.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	for len(f.timers) > 0 && !f.timers[0].deadline.After(end) {
+		t := f.timers[0]
+		f.timers = f.timers[1:]
+		f.now = t.deadline
+		t.fireLocked()
+	}
+	f.now = end
+	f.mu.Unlock()
+}
+
+// BlockUntil blocks until at least n timers are pending, including those of goroutines blocked in Sleep.
+// It lets a test wait for the code under test to arm its timers before advancing the clock.
+func (f *Fake) BlockUntil(n int) {
+	for {
+		f.mu.Lock()
+		pending, changed := len(f.timers), f.changed
+		f.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+// Pending returns the number of timers that have not fired or been stopped.
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	deadline time.Time
+	// Exactly one of c and fn is set.
+	c  chan time.Time
+	fn func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.removeLocked(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	active := f.removeLocked(t)
+	t.deadline = f.now.Add(d)
+	if d <= 0 {
+		t.fireLocked()
+		return active
+	}
+	i, _ := slices.BinarySearchFunc(f.timers, t.deadline, func(t *fakeTimer, deadline time.Time) int {
+		// Timers with the same deadline fire in the order they were armed.
+		if t.deadline.After(deadline) {
+			return 1
+		}
+		return -1
+	})
+	f.timers = slices.Insert(f.timers, i, t)
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return active
+}
+
+// fireLocked delivers the timer's deadline. f.mu must be held.
+func (t *fakeTimer) fireLocked() {
+	if t.fn != nil {
+		go t.fn()
+		return
+	}
+	select {
+	case t.c <- t.deadline:
+	default:
+	}
+}
+
+func (f *Fake) removeLocked(t *fakeTimer) bool {
+	i := slices.Index(f.timers, t)
+	if i < 0 {
+		return false
+	}
+	f.timers = slices.Delete(f.timers, i, i+1)
+	return true
+}
@@ -0,0 +1,89 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/clock"
+)
+
+var epoch = time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeAdvance(t *testing.T) {
+	clk := clock.NewFake(epoch)
+	late := clk.NewTimer(2 * time.Second)
+	early := clk.NewTimer(time.Second)
+
+	clk.Advance(500 * time.Millisecond)
+	select {
+	case <-early.C():
+		t.Fatal("Expected timer not to fire before its deadline")
+	default:
+	}
+
+	clk.Advance(time.Second)
+	if got := <-early.C(); !got.Equal(epoch.Add(time.Second)) {
+		t.Errorf("Expected timer to fire at its deadline, got %s", got.Sub(epoch))
+	}
+	if got := clk.Now(); !got.Equal(epoch.Add(1500 * time.Millisecond)) {
+		t.Errorf("Expected clock to read 1.5s, got %s", got.Sub(epoch))
+	}
+	if clk.Pending() != 1 {
+		t.Errorf("Expected 1 pending timer, got %d", clk.Pending())
+	}
+
+	clk.Advance(time.Second)
+	<-late.C()
+}
+
+func TestFakeStopAndReset(t *testing.T) {
+	clk := clock.NewFake(epoch)
+	timer := clk.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Error("Expected Stop to report an active timer")
+	}
+	clk.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("Expected stopped timer not to fire")
+	default:
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("Expected Reset to report a stopped timer")
+	}
+	clk.Advance(time.Second)
+	<-timer.C()
+	if timer.Stop() {
+		t.Error("Expected Stop to report a fired timer")
+	}
+}
+
+func TestFakeAfterFunc(t *testing.T) {
+	clk := clock.NewFake(epoch)
+	fired := make(chan int, 2)
+	for _, i := range []int{2, 1} {
+		clk.AfterFunc(time.Duration(i)*time.Second, func() {
+			fired <- i
+		})
+	}
+	for _, exp := range []int{1, 2} {
+		clk.Advance(time.Second)
+		if got := <-fired; got != exp {
+			t.Errorf("Expected function %d to run, got %d", exp, got)
+		}
+	}
+}
+
+func TestFakeSleep(t *testing.T) {
+	clk := clock.NewFake(epoch)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		clk.Sleep(time.Minute)
+	}()
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	<-done
+}
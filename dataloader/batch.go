@@ -0,0 +1,161 @@
+package dataloader
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/clock"
+)
+
+// batcher collects the args of concurrent loads and hands them to a single batch loader call.
+// A batch is dispatched when its window elapses or when it reaches the max batch size, whichever happens first.
+type batcher[TArg any, TRes any] struct {
+	batchLoader  func(ctx context.Context, args []TArg) ([]TRes, []error)
+	window       time.Duration
+	maxBatchSize int
+	clock        clock.Clock
+	stats        *stats
+	// limiter is nil if batch loader calls are not limited.
+	limiter *limiter
+
+	mu      sync.Mutex
+	pending *batch[TArg, TRes]
+}
+
+type batch[TArg any, TRes any] struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	args   []TArg
+	outs   []chan Result[TRes]
+	timer  clock.Timer
+	// waiting is the number of loads still waiting for the batch. The batch is cancelled when it drops to 0.
+	waiting int
+}
+
+func newBatcher[TArg any, TRes any](batchLoader func(ctx context.Context, args []TArg) ([]TRes, []error), cfg config, st *stats, lim *limiter) *batcher[TArg, TRes] {
+	return &batcher[TArg, TRes]{
+		batchLoader:  batchLoader,
+		window:       cfg.batchWindow,
+		maxBatchSize: cfg.maxBatchSize,
+		clock:        cfg.clock,
+		stats:        st,
+		limiter:      lim,
+	}
+}
+
+// load adds arg to the pending batch and blocks until the batch containing it has been loaded.
+func (b *batcher[TArg, TRes]) load(ctx context.Context, arg TArg) (TRes, error) {
+	// Buffered so that dispatch never blocks on a caller.
+	out := make(chan Result[TRes], 1)
+
+	b.mu.Lock()
+	if b.pending == nil {
+		// The batch keeps the values of the context of the load that opened it,
+		// but is only cancelled once every load in the batch has gone away.
+		batchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		bt := &batch[TArg, TRes]{
+			ctx:    batchCtx,
+			cancel: cancel,
+		}
+		bt.timer = b.clock.AfterFunc(b.window, func() {
+			b.flush(bt)
+		})
+		b.pending = bt
+	}
+	bt := b.pending
+	bt.args = append(bt.args, arg)
+	bt.outs = append(bt.outs, out)
+	bt.waiting++
+	full := b.maxBatchSize > 0 && len(bt.args) >= b.maxBatchSize
+	if full {
+		bt.timer.Stop()
+		b.pending = nil
+	}
+	b.mu.Unlock()
+
+	if full {
+		go b.dispatch(bt)
+	}
+
+	select {
+	case res := <-out:
+		return res.value, res.err
+	case <-ctx.Done():
+		b.mu.Lock()
+		bt.waiting--
+		if bt.waiting == 0 {
+			bt.cancel()
+			if b.pending == bt {
+				// Loads that arrive later must not join a cancelled batch.
+				bt.timer.Stop()
+				b.pending = nil
+			}
+		}
+		b.mu.Unlock()
+		var zero TRes
+		return zero, ctx.Err()
+	}
+}
+
+// flush dispatches bt when its window elapses, unless it was already dispatched for being full.
+func (b *batcher[TArg, TRes]) flush(bt *batch[TArg, TRes]) {
+	b.mu.Lock()
+	if b.pending != bt {
+		b.mu.Unlock()
+		return
+	}
+	b.pending = nil
+	b.mu.Unlock()
+
+	b.dispatch(bt)
+}
+
+func (b *batcher[TArg, TRes]) dispatch(bt *batch[TArg, TRes]) {
+	defer bt.cancel()
+	if b.limiter != nil {
+		release, err := b.limiter.acquire(bt.ctx)
+		if err != nil {
+			bt.fail(err)
+			return
+		}
+		defer release()
+	}
+	b.stats.batches.Add(1)
+	var values []TRes
+	var errs []error
+	_, err := recoverPanic(func() (struct{}, error) {
+		values, errs = b.batchLoader(bt.ctx, bt.args)
+		return struct{}{}, nil
+	})
+	if err != nil {
+		bt.fail(err)
+		return
+	}
+
+	// Either slice may be nil, e.g. when the whole batch failed or succeeded, but not both.
+	n := len(bt.args)
+	if (values != nil || errs == nil) && len(values) != n || errs != nil && len(errs) != n {
+		bt.fail(fmt.Errorf("batch loader returned %d values and %d errors for %d keys", len(values), len(errs), n))
+		return
+	}
+
+	for i, out := range bt.outs {
+		var res Result[TRes]
+		if values != nil {
+			res.value = values[i]
+		}
+		if errs != nil {
+			res.err = errs[i]
+		}
+		out <- res
+	}
+}
+
+// fail delivers err to every load in the batch.
+func (bt *batch[TArg, TRes]) fail(err error) {
+	for _, out := range bt.outs {
+		out <- Result[TRes]{err: err}
+	}
+}
@@ -0,0 +1,186 @@
+package dataloader_test
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/dataloader"
+)
+
+// benchLoader is the part of MultiRequestDataLoader that BenchmarkMultiRequestDataLoader exercises.
+type benchLoader interface {
+	Load(ctx context.Context, la dataloader.LoaderArg[int64]) (int64, error)
+	Close(ctx context.Context) error
+}
+
+// BenchmarkMultiRequestDataLoader compares concurrent loads through MultiRequestDataLoader (impl=sharded)
+// with the single lock design it replaced (impl=legacy). Run it on several cores to measure lock contention, e.g.
+//
+//	go test -run '^$' -bench MultiRequestDataLoader -cpu 1,4,16 -count 10 ./dataloader > bench.txt
+//	benchstat -col /impl bench.txt
+func BenchmarkMultiRequestDataLoader(b *testing.B) {
+	load := func(ctx context.Context, arg int64) (int64, error) {
+		return arg, nil
+	}
+	impls := []struct {
+		name string
+		new  func(maxLoaders int) benchLoader
+	}{
+		{"legacy", func(maxLoaders int) benchLoader {
+			return newLegacyMultiRequestDataLoader(load, maxLoaders)
+		}},
+		{"sharded", func(maxLoaders int) benchLoader {
+			return dataloader.NewMultiRequestDataLoader(load, dataloader.WithMaxLoaders(maxLoaders))
+		}},
+	}
+	for _, bm := range []struct {
+		name       string
+		keys       int
+		maxLoaders int
+	}{
+		{"hot key", 1, 0},
+		{"1024 keys", 1024, 0},
+		{"1024 keys max 256 loaders", 1024, 256},
+	} {
+		for _, impl := range impls {
+			b.Run(bm.name+"/impl="+impl.name, func(b *testing.B) {
+				args := make([]int64Arg, bm.keys)
+				for i := range args {
+					args[i] = int64Arg(i)
+				}
+				loader := impl.new(bm.maxLoaders)
+				defer loader.Close(context.Background())
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					ctx := context.Background()
+					i := 0
+					for pb.Next() {
+						if _, err := loader.Load(ctx, args[i%len(args)]); err != nil {
+							b.Error(err)
+						}
+						i++
+					}
+				})
+			})
+		}
+	}
+}
+
+// legacyMultiRequestDataLoader is the design that MultiRequestDataLoader replaced, kept as the baseline of
+// BenchmarkMultiRequestDataLoader. A single mutex guards every per-key loader, and is taken both when a Load
+// starts and when it finishes. Each Load forwards the per-key loader's result through a goroutine and a channel.
+type legacyMultiRequestDataLoader[TArg any, TRes any] struct {
+	loader     func(ctx context.Context, arg TArg) (TRes, error)
+	maxLoaders int
+	wg         sync.WaitGroup
+
+	mu      sync.Mutex
+	loaders map[string]*legacyLoaderEntry[TRes]
+	// lru orders the entries of loaders from most to least recently used.
+	lru *list.List
+}
+
+type legacyLoaderEntry[TRes any] struct {
+	key      string
+	loader   *dataloader.SingleRequestDataLoader[TRes]
+	elem     *list.Element
+	active   int
+	lastUsed time.Time
+}
+
+func newLegacyMultiRequestDataLoader[TArg any, TRes any](loader func(ctx context.Context, arg TArg) (TRes, error), maxLoaders int) *legacyMultiRequestDataLoader[TArg, TRes] {
+	return &legacyMultiRequestDataLoader[TArg, TRes]{
+		loader:     loader,
+		maxLoaders: maxLoaders,
+		loaders:    make(map[string]*legacyLoaderEntry[TRes]),
+		lru:        list.New(),
+	}
+}
+
+func (r *legacyMultiRequestDataLoader[TArg, TRes]) Load(ctx context.Context, la dataloader.LoaderArg[TArg]) (TRes, error) {
+	key := la.Key()
+	arg := la.Arg()
+
+	r.mu.Lock()
+	entry := r.acquireLocked(key, func() *dataloader.SingleRequestDataLoader[TRes] {
+		return dataloader.NewSingleRequestDataLoader(func(ctx context.Context) (TRes, error) {
+			return r.loader(ctx, arg)
+		})
+	})
+	defer r.release(entry)
+
+	type result struct {
+		value TRes
+		err   error
+	}
+	resCh := make(chan result)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		value, err := entry.loader.Load(ctx)
+		resCh <- result{value, err}
+	}()
+	r.mu.Unlock()
+	res := <-resCh
+	return res.value, res.err
+}
+
+// acquireLocked returns the entry for key, creating it with newLoader if needed, and marks it as in use.
+// r.mu must be held.
+func (r *legacyMultiRequestDataLoader[TArg, TRes]) acquireLocked(key string, newLoader func() *dataloader.SingleRequestDataLoader[TRes]) *legacyLoaderEntry[TRes] {
+	entry, ok := r.loaders[key]
+	if !ok {
+		entry = &legacyLoaderEntry[TRes]{
+			key:    key,
+			loader: newLoader(),
+		}
+		entry.elem = r.lru.PushFront(entry)
+		r.loaders[key] = entry
+	} else {
+		r.lru.MoveToFront(entry.elem)
+	}
+	entry.active++
+	return entry
+}
+
+// release marks entry as no longer used by a Load, and evicts the least recently used inactive loaders
+// that exceed maxLoaders.
+func (r *legacyMultiRequestDataLoader[TArg, TRes]) release(entry *legacyLoaderEntry[TRes]) {
+	r.mu.Lock()
+	entry.active--
+	entry.lastUsed = time.Now()
+	r.lru.MoveToFront(entry.elem)
+	var evicted []*dataloader.SingleRequestDataLoader[TRes]
+	if r.maxLoaders > 0 {
+		for elem := r.lru.Back(); elem != nil && len(r.loaders) > r.maxLoaders; {
+			e := elem.Value.(*legacyLoaderEntry[TRes])
+			elem = elem.Prev()
+			if e.active > 0 {
+				continue
+			}
+			delete(r.loaders, e.key)
+			r.lru.Remove(e.elem)
+			evicted = append(evicted, e.loader)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, loader := range evicted {
+		loader.Close(context.Background())
+	}
+}
+
+func (r *legacyMultiRequestDataLoader[TArg, TRes]) Close(ctx context.Context) error {
+	r.wg.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range r.loaders {
+		entry.loader.Close(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package dataloader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/clock"
+)
+
+// Cache stores loaded results by key for a MultiRequestDataLoader. Implementations must be safe for concurrent use.
+// A Cache may be shared by several loaders, as long as they load the same keys.
+type Cache[TRes any] interface {
+	// Get returns the entry for key, and false if there is none. Entries past their ExpiresAt may be omitted.
+	Get(ctx context.Context, key string) (CacheEntry[TRes], bool, error)
+	// Set stores entry for key, replacing any existing entry.
+	Set(ctx context.Context, key string, entry CacheEntry[TRes]) error
+	// Delete removes the entry for key, if any.
+	Delete(ctx context.Context, key string) error
+	// Clear removes every entry.
+	Clear(ctx context.Context) error
+}
+
+// CacheEntry is a cached result.
+type CacheEntry[TRes any] struct {
+	Value TRes
+	// Err is set instead of Value for negatively cached results.
+	Err error
+	// RefreshAt is when the entry should be reloaded in the background. The zero value means never.
+	RefreshAt time.Time
+	// ExpiresAt is when the entry must no longer be returned. The zero value means never.
+	ExpiresAt time.Time
+}
+
+func (e CacheEntry[TRes]) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// CachedError is a negatively cached error that was read back from a Cache that stores errors as text.
+// It unwraps to the WithNegativeCache error that its message ends with, so that errors.Is still matches.
+type CachedError struct {
+	Message string
+	target  error
+}
+
+func (e *CachedError) Error() string {
+	return e.Message
+}
+
+func (e *CachedError) Unwrap() error {
+	return e.target
+}
+
+// MemoryCache is a Cache that holds entries in memory. It is the default Cache of a MultiRequestDataLoader.
+type MemoryCache[TRes any] struct {
+	clock   clock.Clock
+	mu      sync.Mutex
+	entries map[string]CacheEntry[TRes]
+}
+
+func NewMemoryCache[TRes any]() *MemoryCache[TRes] {
+	return newMemoryCache[TRes](clock.Real())
+}
+
+func newMemoryCache[TRes any](clk clock.Clock) *MemoryCache[TRes] {
+	return &MemoryCache[TRes]{
+		clock:   clk,
+		entries: make(map[string]CacheEntry[TRes]),
+	}
+}
+
+func (c *MemoryCache[TRes]) Get(_ context.Context, key string) (CacheEntry[TRes], bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return CacheEntry[TRes]{}, false, nil
+	}
+	if entry.expired(c.clock.Now()) {
+		delete(c.entries, key)
+		return CacheEntry[TRes]{}, false, nil
+	}
+	return entry, true, nil
+}
+
+func (c *MemoryCache[TRes]) Set(_ context.Context, key string, entry CacheEntry[TRes]) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry
+	return nil
+}
+
+func (c *MemoryCache[TRes]) Delete(_ context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+func (c *MemoryCache[TRes]) Clear(_ context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]CacheEntry[TRes])
+	return nil
+}
+
+// resultCache applies a loader's caching policy on top of a Cache.
+// Entries past their refresh time are still returned, but are flagged for a background refresh.
+type resultCache[TRes any] struct {
+	backend Cache[TRes]
+	// cacheValues is false if only errors are cached.
+	cacheValues  bool
+	ttl          time.Duration
+	staleAfter   time.Duration
+	refreshAhead time.Duration
+	negativeTTL  time.Duration
+	cfg          config
+	clock        clock.Clock
+
+	mu sync.Mutex
+	// refreshing holds the keys that a background refresh has been requested for.
+	refreshing map[string]struct{}
+	// epoch is incremented whenever entries are cleared, so that loads started before a clear do not store stale results.
+	epoch uint64
+}
+
+func newResultCache[TRes any](cfg config, backend Cache[TRes]) *resultCache[TRes] {
+	return &resultCache[TRes]{
+		backend:      backend,
+		cacheValues:  cfg.cacheEnabled,
+		ttl:          cfg.cacheTTL,
+		staleAfter:   cfg.staleAfter,
+		refreshAhead: cfg.refreshAhead,
+		negativeTTL:  cfg.negativeTTL,
+		cfg:          cfg,
+		clock:        cfg.clock,
+		refreshing:   make(map[string]struct{}),
+	}
+}
+
+// get returns the cached result for key. refresh is true for the first get after the entry's refresh time,
+// in which case the caller should reload key in the background.
+// Errors from the backend are treated as misses.
+func (c *resultCache[TRes]) get(ctx context.Context, key string) (res Result[TRes], ok bool, refresh bool) {
+	entry, ok, err := c.backend.Get(ctx, key)
+	if err != nil || !ok {
+		return Result[TRes]{}, false, false
+	}
+	now := c.clock.Now()
+	if entry.expired(now) {
+		c.backend.Delete(ctx, key)
+		return Result[TRes]{}, false, false
+	}
+	res = Result[TRes]{
+		value: entry.Value,
+		err:   c.resolveErr(entry.Err),
+	}
+	if entry.RefreshAt.IsZero() || now.Before(entry.RefreshAt) {
+		return res, true, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.refreshing[key]; ok {
+		return res, true, false
+	}
+	c.refreshing[key] = struct{}{}
+	return res, true, true
+}
+
+// lookup returns the cached result for key, unless it is missing or due for a refresh.
+// Unlike get, it never requests a background refresh, so that a refresh in flight does not return the result it is replacing.
+func (c *resultCache[TRes]) lookup(ctx context.Context, key string) (Result[TRes], bool) {
+	entry, ok, err := c.backend.Get(ctx, key)
+	if err != nil || !ok {
+		return Result[TRes]{}, false
+	}
+	now := c.clock.Now()
+	if entry.expired(now) || !entry.RefreshAt.IsZero() && !now.Before(entry.RefreshAt) {
+		return Result[TRes]{}, false
+	}
+	return Result[TRes]{
+		value: entry.Value,
+		err:   c.resolveErr(entry.Err),
+	}, true
+}
+
+// resolveErr makes a *CachedError unwrap to the not found error that its message ends with.
+func (c *resultCache[TRes]) resolveErr(err error) error {
+	cached, ok := err.(*CachedError)
+	if !ok || cached.target != nil {
+		return err
+	}
+	target := c.cfg.notFoundSuffix(cached.Message)
+	if target == nil {
+		return err
+	}
+	return &CachedError{
+		Message: cached.Message,
+		target:  target,
+	}
+}
+
+// retryRefresh allows the next get of key to request another background refresh.
+func (c *resultCache[TRes]) retryRefresh(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.refreshing, key)
+}
+
+func (c *resultCache[TRes]) currentEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// set stores value unless the cache was cleared after epoch was observed.
+func (c *resultCache[TRes]) set(ctx context.Context, key string, value TRes, epoch uint64) error {
+	if !c.cacheValues {
+		return nil
+	}
+	return c.store(ctx, key, c.newEntry(value), epoch)
+}
+
+// setNegative stores err for the negative cache TTL unless the cache was cleared after epoch was observed.
+func (c *resultCache[TRes]) setNegative(ctx context.Context, key string, err error, epoch uint64) error {
+	return c.store(ctx, key, CacheEntry[TRes]{
+		Err:       err,
+		ExpiresAt: c.clock.Now().Add(c.negativeTTL),
+	}, epoch)
+}
+
+// store sets entry unless the cache was cleared after epoch was observed.
+// The backend may do I/O, so it is called without holding c.mu, and a clear may race with it.
+func (c *resultCache[TRes]) store(ctx context.Context, key string, entry CacheEntry[TRes], epoch uint64) error {
+	if c.currentEpoch() != epoch {
+		return nil
+	}
+	if err := c.backend.Set(ctx, key, entry); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	cleared := epoch != c.epoch
+	if !cleared {
+		delete(c.refreshing, key)
+	}
+	c.mu.Unlock()
+	if cleared {
+		// The clear may have removed its entries before Set stored this one.
+		return c.backend.Delete(ctx, key)
+	}
+	return nil
+}
+
+func (c *resultCache[TRes]) prime(ctx context.Context, key string, value TRes) error {
+	if err := c.backend.Set(ctx, key, c.newEntry(value)); err != nil {
+		return err
+	}
+	c.retryRefresh(key)
+	return nil
+}
+
+func (c *resultCache[TRes]) newEntry(value TRes) CacheEntry[TRes] {
+	now := c.clock.Now()
+	entry := CacheEntry[TRes]{
+		Value: value,
+	}
+	if c.ttl > 0 {
+		entry.ExpiresAt = now.Add(c.ttl)
+	}
+	if c.staleAfter > 0 {
+		entry.RefreshAt = now.Add(c.staleAfter)
+	}
+	if c.ttl > 0 && c.refreshAhead > 0 {
+		refreshAt := entry.ExpiresAt.Add(-c.refreshAhead)
+		if entry.RefreshAt.IsZero() || refreshAt.Before(entry.RefreshAt) {
+			entry.RefreshAt = refreshAt
+		}
+	}
+	return entry
+}
+
+func (c *resultCache[TRes]) clear(ctx context.Context, key string) error {
+	c.mu.Lock()
+	delete(c.refreshing, key)
+	c.epoch++
+	c.mu.Unlock()
+	return c.backend.Delete(ctx, key)
+}
+
+func (c *resultCache[TRes]) clearAll(ctx context.Context) error {
+	c.mu.Lock()
+	c.refreshing = make(map[string]struct{})
+	c.epoch++
+	c.mu.Unlock()
+	return c.backend.Clear(ctx)
+}
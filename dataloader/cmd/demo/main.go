@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/dataloader"
+)
+
+func main() {
+	runMultiDataLoader()
+	//runSimpleDataLoader()
+	//runBatchDataLoader()
+}
+
+func runSimpleDataLoader() {
+	requestsCount := 25
+	counter := atomic.Uint64{}
+	loader := dataloader.NewSingleRequestDataLoader(func(ctx context.Context) (int64, error) {
+		counter.Add(1)
+		time.Sleep(1 * time.Second)
+		return rand.Int63(), nil
+	})
+	var wg sync.WaitGroup
+	ctx := context.Background()
+
+	wg.Add(requestsCount)
+	go func() {
+		time.Sleep(2 * time.Second)
+		loader.Close(context.Background())
+	}()
+	for i := 0; i < requestsCount; i++ {
+		time.Sleep(100 * time.Millisecond)
+		go func(i int) {
+			defer wg.Done()
+			fmt.Printf("submitting request %d\n", i)
+			res, err := loader.Load(ctx)
+			if err != nil {
+				fmt.Printf("request %d err: %v\n", i, err)
+			} else {
+				fmt.Printf("request %d: %v\n", i, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+	fmt.Println("Done!")
+	fmt.Printf("Loader function called %d times.\n", counter.Load())
+	fmt.Printf("Stats: %+v\n", loader.Stats())
+}
+
+func runMultiDataLoader() {
+	requestsCount := 200
+	counter := atomic.Uint64{}
+	loader := dataloader.NewKeyedDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		counter.Add(1)
+		time.Sleep(1 * time.Second)
+		return arg, nil
+	})
+	var wg sync.WaitGroup
+	ctx := context.Background()
+
+	wg.Add(requestsCount)
+	go func() {
+		time.Sleep(2 * time.Second)
+		loader.Close(context.Background())
+	}()
+	for i := 0; i < requestsCount; i++ {
+		time.Sleep(10 * time.Millisecond)
+		go func(i int) {
+			defer wg.Done()
+			fmt.Printf("submitting request %d\n", i)
+			res, err := loader.Load(ctx, int64(i%10))
+			if err != nil {
+				fmt.Printf("request %d err: %v\n", i, err)
+			} else {
+				fmt.Printf("request %d: %v\n", i, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+	fmt.Println("Done!")
+	fmt.Printf("Loader function called %d times.\n", counter.Load())
+	fmt.Printf("Stats: %+v\n", loader.Stats())
+}
+
+func runBatchDataLoader() {
+	requestsCount := 200
+	counter := atomic.Uint64{}
+	loader := dataloader.NewBatchMultiRequestDataLoader(func(ctx context.Context, args []int64) ([]int64, []error) {
+		counter.Add(1)
+		time.Sleep(1 * time.Second)
+		return args, nil
+	}, dataloader.WithBatchWindow(50*time.Millisecond))
+	var wg sync.WaitGroup
+	ctx := context.Background()
+
+	wg.Add(requestsCount)
+	for i := 0; i < requestsCount; i++ {
+		time.Sleep(10 * time.Millisecond)
+		go func(i int) {
+			defer wg.Done()
+			fmt.Printf("submitting request %d\n", i)
+			res, err := loader.Load(ctx, int64Arg(i%10))
+			if err != nil {
+				fmt.Printf("request %d err: %v\n", i, err)
+			} else {
+				fmt.Printf("request %d: %v\n", i, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+	loader.Close(context.Background())
+	fmt.Println("Done!")
+	fmt.Printf("Batch loader function called %d times.\n", counter.Load())
+	fmt.Printf("Stats: %+v\n", loader.Stats())
+}
+
+type int64Arg int64
+
+func (a int64Arg) Arg() int64 {
+	return int64(a)
+}
+func (a int64Arg) Key() string {
+	return strconv.FormatInt(int64(a), 10)
+}
@@ -0,0 +1,22 @@
+package dataloader
+
+import "encoding/json"
+
+// Codec serializes loaded results, e.g. for a Cache that persists them, or args and results forwarded WithPeers.
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// JSONCodec is a Codec that encodes results as JSON.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
@@ -1,262 +1,497 @@
-package main
+// Package dataloader coalesces concurrent loads of the same key into a single call to a backend.
+package dataloader
 
 import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
-	"strconv"
+	"hash/maphash"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
-)
-
-func main() {
-	runMultiDataLoader()
-	//runSimpleDataLoader()
-}
-
-func runSimpleDataLoader() {
-	requestsCount := 25
-	counter := atomic.Uint64{}
-	loader := NewSingleRequestDataLoader(func(ctx context.Context) (int64, error) {
-		counter.Add(1)
-		time.Sleep(1 * time.Second)
-		return rand.Int63(), nil
-	})
-	var wg sync.WaitGroup
-	ctx := context.Background()
 
-	wg.Add(requestsCount)
-	go func() {
-		time.Sleep(2 * time.Second)
-		loader.Close()
-	}()
-	for i := 0; i < requestsCount; i++ {
-		time.Sleep(100 * time.Millisecond)
-		go func(i int) {
-			defer wg.Done()
-			fmt.Printf("submitting request %d\n", i)
-			res, err := loader.Load(ctx)
-			if err != nil {
-				fmt.Printf("request %d err: %v\n", i, err)
-			} else {
-				fmt.Printf("request %d: %v\n", i, res)
-			}
-		}(i)
-	}
-	wg.Wait()
-	fmt.Println("Done!")
-	fmt.Printf("Loader function called %d times.\n", counter.Load())
-}
-
-func runMultiDataLoader() {
-	requestsCount := 200
-	counter := atomic.Uint64{}
-	loader := NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
-		counter.Add(1)
-		time.Sleep(1 * time.Second)
-		return arg, nil
-	})
-	var wg sync.WaitGroup
-	ctx := context.Background()
+	"github.com/joshchoo/go-sandbox/clock"
+)
 
-	wg.Add(requestsCount)
-	go func() {
-		time.Sleep(2 * time.Second)
-		loader.Close()
-	}()
-	for i := 0; i < requestsCount; i++ {
-		time.Sleep(10 * time.Millisecond)
-		go func(i int) {
-			defer wg.Done()
-			fmt.Printf("submitting request %d\n", i)
-			res, err := loader.Load(ctx, int64Arg(i%10))
-			if err != nil {
-				fmt.Printf("request %d err: %v\n", i, err)
-			} else {
-				fmt.Printf("request %d: %v\n", i, res)
-			}
-		}(i)
-	}
-	wg.Wait()
-	fmt.Println("Done!")
-	fmt.Printf("Loader function called %d times.\n", counter.Load())
-}
+// ErrClosed is returned by loads on a data loader that has been closed,
+// including loads that were still waiting when Close gave up on them.
+var ErrClosed = errors.New("data loader is closed")
 
+// LoaderArg is the argument of a MultiRequestDataLoader load, and the key that loads are coalesced by.
 type LoaderArg[TArg any] interface {
 	Arg() TArg
 	Key() string
 }
 
-type int64Arg int64
-
-func (a int64Arg) Arg() int64 {
-	return int64(a)
+// MultiRequestDataLoader coalesces concurrent loads of the same key into a single loader call per key.
+// Per-key loaders can be bounded WithMaxLoaders and evicted WithIdleTimeout.
+type MultiRequestDataLoader[TArg any, TRes any] struct {
+	// shards holds the per-key loaders, partitioned by a hash of their key.
+	shards   []*shard[TRes]
+	seed     maphash.Seed
+	loader   func(ctx context.Context, arg TArg) (TRes, error)
+	wg       sync.WaitGroup
+	cfg      config
+	stop     chan struct{}
+	stopOnce sync.Once
+	// closed rejects loads before they read the cache. Each shard also rejects them, for loads that raced with Close.
+	closed   atomic.Bool
+	sweepers sync.WaitGroup
+	stats    *stats
+	// cache is nil unless the loader was created WithCache or WithNegativeCache.
+	cache *resultCache[TRes]
+	// peers is nil unless the loader was created WithPeers.
+	peers *peerGroup[TArg, TRes]
 }
-func (a int64Arg) Key() string {
-	return strconv.FormatInt(int64(a), 10)
+
+func NewMultiRequestDataLoader[TArg any, TRes any](loader func(ctx context.Context, arg TArg) (TRes, error), opts ...Option) *MultiRequestDataLoader[TArg, TRes] {
+	cfg := newConfig(opts)
+	return newMultiRequestDataLoader(loader, cfg, &stats{}, newLimiter(cfg))
 }
 
-/*
-Possible improvements:
-- Add ability to evict SingleRequestDataLoader that is infrequently used (e.g. LRU).
-*/
-type MultiRequestDataLoader[TArg any, TRes any] struct {
-	reqKeyToLoader map[string]*SingleRequestDataLoader[TRes]
-	mu             *sync.Mutex
-	loader         func(ctx context.Context, arg TArg) (TRes, error)
-	closed         bool
-	wg             sync.WaitGroup
+// NewBatchMultiRequestDataLoader creates a MultiRequestDataLoader that loads distinct keys together.
+// Keys requested within the batch window (see WithBatchWindow and WithMaxBatchSize) are passed to a single batchLoader call.
+// batchLoader must return values and errors in the same order as args, and either slice may be nil.
+// Concurrent loads of the same key are still coalesced, so each key appears at most once per batch.
+func NewBatchMultiRequestDataLoader[TArg any, TRes any](batchLoader func(ctx context.Context, args []TArg) ([]TRes, []error), opts ...Option) *MultiRequestDataLoader[TArg, TRes] {
+	cfg := newConfig(opts)
+	st := &stats{}
+	b := newBatcher(batchLoader, cfg, st, newLimiter(cfg))
+	return newMultiRequestDataLoader(b.load, cfg, st, nil)
 }
 
-func NewMultiRequestDataLoader[TArg any, TRes any](loader func(ctx context.Context, arg TArg) (TRes, error)) *MultiRequestDataLoader[TArg, TRes] {
-	return &MultiRequestDataLoader[TArg, TRes]{
-		reqKeyToLoader: make(map[string]*SingleRequestDataLoader[TRes]),
-		mu:             &sync.Mutex{},
-		loader:         loader,
-		closed:         false,
-		wg:             sync.WaitGroup{},
+func newMultiRequestDataLoader[TArg any, TRes any](loader func(ctx context.Context, arg TArg) (TRes, error), cfg config, st *stats, lim *limiter) *MultiRequestDataLoader[TArg, TRes] {
+	r := &MultiRequestDataLoader[TArg, TRes]{
+		shards: newShards[TRes](cfg),
+		seed:   maphash.MakeSeed(),
+		loader: guard(loader, cfg, st, lim),
+		cfg:    cfg,
+		stop:   make(chan struct{}),
+		stats:  st,
 	}
+	if cfg.cacheEnabled || len(cfg.notFound) > 0 {
+		var backend Cache[TRes] = newMemoryCache[TRes](cfg.clock)
+		if cfg.cacheBackend != nil {
+			b, ok := cfg.cacheBackend.(Cache[TRes])
+			if !ok {
+				panic(fmt.Sprintf("dataloader: cache backend %T does not implement Cache[%T]", cfg.cacheBackend, *new(TRes)))
+			}
+			backend = b
+		}
+		r.cache = newResultCache(cfg, backend)
+	}
+	if cfg.peers != nil {
+		r.peers = newPeerGroup[TArg, TRes](cfg)
+	}
+	if cfg.idleTimeout > 0 {
+		r.sweepers.Add(1)
+		go r.sweepIdle()
+	}
+	return r
 }
 
 func (r *MultiRequestDataLoader[TArg, TRes]) Load(ctx context.Context, la LoaderArg[TArg]) (TRes, error) {
 	key := la.Key()
 	arg := la.Arg()
 
-	r.mu.Lock()
-	if r.closed {
-		r.mu.Unlock()
+	if r.closed.Load() {
 		var zero TRes
-		return zero, errors.New("multi request data loader is closed")
+		return zero, ErrClosed
 	}
-	_, ok := r.reqKeyToLoader[key]
-	if !ok {
-		r.reqKeyToLoader[key] = NewSingleRequestDataLoader(func(ctx context.Context) (TRes, error) {
-			return r.loader(ctx, arg)
-		})
+	if r.cache != nil {
+		// The cache is read without holding a shard lock, since its backend may do I/O.
+		if res, ok, refresh := r.cache.get(ctx, key); ok {
+			r.stats.cacheHits.Add(1)
+			if refresh {
+				r.refresh(ctx, key, arg)
+			}
+			return res.value, res.err
+		}
+		r.stats.cacheMisses.Add(1)
 	}
-	r.mu.Unlock()
 
-	resCh := make(chan Result[TRes])
-	r.mu.Lock()
-	if r.closed {
-		r.mu.Unlock()
+	s := r.shardFor(key)
+	entry, ok := r.acquire(s, key, arg)
+	if !ok {
 		var zero TRes
-		return zero, errors.New("multi request data loader is closed")
+		return zero, ErrClosed
 	}
-	loader := r.reqKeyToLoader[key]
-	r.wg.Add(1)
+	defer r.release(s, entry)
+	return entry.loader.Load(ctx)
+}
+
+// refresh reloads key in the background, coalescing with any loads of key that are in flight.
+// The reload keeps the values of ctx, but is not cancelled with it.
+func (r *MultiRequestDataLoader[TArg, TRes]) refresh(ctx context.Context, key string, arg TArg) {
+	s := r.shardFor(key)
+	s.mu.Lock()
+	entry, ok := r.acquireLocked(s, key, arg)
+	if ok {
+		// Close only waits on r.wg after closing every shard under its lock,
+		// so adding to it while the shard is still open cannot race that wait, and Close cannot miss this refresh.
+		r.wg.Add(1)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	r.stats.refreshes.Add(1)
 	go func() {
 		defer r.wg.Done()
-		res, err := loader.Load(ctx)
-		resCh <- Result[TRes]{
-			value: res,
-			err:   err,
+		defer r.release(s, entry)
+		if _, err := entry.loader.Load(context.WithoutCancel(ctx)); err != nil {
+			// Keep serving the cached result, and try again on the next load.
+			r.cache.retryRefresh(key)
 		}
 	}()
-	r.mu.Unlock()
-	res := <-resCh
-	return res.value, res.err
 }
 
-func (r *MultiRequestDataLoader[TArg, TRes]) Close() {
-	fmt.Println("Closing multi request data loader...")
-	r.mu.Lock()
-	r.closed = true
-	r.mu.Unlock()
+func (r *MultiRequestDataLoader[TArg, TRes]) newKeyLoader(key string, arg TArg) *SingleRequestDataLoader[TRes] {
+	return newSingleRequestDataLoader(func(ctx context.Context) (TRes, error) {
+		return r.load(ctx, key, arg)
+	}, key, r.cfg, r.stats)
+}
+
+// load calls the loader for a single flight of key, and caches a successful or not found result.
+func (r *MultiRequestDataLoader[TArg, TRes]) load(ctx context.Context, key string, arg TArg) (TRes, error) {
+	if r.cache == nil {
+		return r.callLoader(ctx, key, arg)
+	}
+	epoch := r.cache.currentEpoch()
+	// A load can miss the cache just before the previous flight of key stores its result,
+	// so check again now that this load owns the flight, rather than call the loader for a result that is already cached.
+	if res, ok := r.cache.lookup(ctx, key); ok {
+		return res.value, res.err
+	}
+	res, err := r.callLoader(ctx, key, arg)
+	// Failing to cache the result should not fail the load.
+	switch {
+	case err == nil:
+		r.cache.set(ctx, key, res, epoch)
+	case r.cfg.isNotFound(err):
+		r.cache.setNegative(ctx, key, err, epoch)
+	}
+	return res, err
+}
+
+// callLoader forwards the load of key to the peer owning it, if that is another process, and otherwise calls the loader.
+func (r *MultiRequestDataLoader[TArg, TRes]) callLoader(ctx context.Context, key string, arg TArg) (TRes, error) {
+	if r.peers != nil {
+		if res, err, ok := r.peers.forward(ctx, key, arg, r.stats); ok {
+			return res, err
+		}
+	}
+	return r.loader(ctx, arg)
+}
+
+// Stats returns a snapshot of the loader's counters, aggregated across keys.
+func (r *MultiRequestDataLoader[TArg, TRes]) Stats() Stats {
+	return r.stats.snapshot()
+}
+
+// Prime stores value in the cache for key, so that the next Load of key returns it without calling the loader.
+// It is a no-op unless the loader was created WithCache or WithNegativeCache.
+func (r *MultiRequestDataLoader[TArg, TRes]) Prime(key string, value TRes) error {
+	if r.cache == nil {
+		return nil
+	}
+	return r.cache.prime(context.Background(), key, value)
+}
+
+// Clear removes the cached result for key, if any.
+// A load of key that is already in flight will not store its result.
+func (r *MultiRequestDataLoader[TArg, TRes]) Clear(key string) error {
+	if r.cache == nil {
+		return nil
+	}
+	return r.cache.clear(context.Background(), key)
+}
+
+// ClearAll removes every cached result, including those stored by other loaders sharing the cache backend.
+func (r *MultiRequestDataLoader[TArg, TRes]) ClearAll() error {
+	if r.cache == nil {
+		return nil
+	}
+	return r.cache.clearAll(context.Background())
+}
+
+// Close rejects new loads with ErrClosed, and closes every per-key loader.
+// Loads that are already in flight may finish until ctx is done, after which their callers receive ErrClosed,
+// their loader calls are cancelled, and Close returns ctx.Err().
+// Close returns once every goroutine started by the loader has exited, except for those cancelled loader calls:
+// Close does not wait for them, so a loader that ignores cancellation keeps running after Close returns.
+func (r *MultiRequestDataLoader[TArg, TRes]) Close(ctx context.Context) error {
+	r.closed.Store(true)
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	var loaders []*SingleRequestDataLoader[TRes]
+	for _, s := range r.shards {
+		s.mu.Lock()
+		loaders = append(loaders, s.closeLocked()...)
+		s.mu.Unlock()
+	}
+	r.sweepers.Wait()
+
+	var aborted atomic.Bool
+	var wg sync.WaitGroup
+	for _, loader := range loaders {
+		wg.Add(1)
+		go func(loader *SingleRequestDataLoader[TRes]) {
+			defer wg.Done()
+			if err := loader.Close(ctx); err != nil {
+				aborted.Store(true)
+			}
+		}(loader)
+	}
+	wg.Wait()
 	r.wg.Wait()
-	fmt.Println("Multi request data loader closed!")
+	if r.peers != nil {
+		r.peers.closeIdleConnections()
+	}
+	if aborted.Load() {
+		return ctx.Err()
+	}
+	return nil
 }
 
+// SingleRequestDataLoader coalesces concurrent loads into a single loader call.
+// The loader runs with a context that is only cancelled once every caller waiting for it has gone away.
 type SingleRequestDataLoader[TRes any] struct {
-	requests chan Request[TRes]
-	closeCh  chan struct{}
+	requests    chan Request[TRes]
+	unsubscribe chan chan Result[TRes]
+	closeCh     chan struct{}
+	// abort is closed when Close gives up waiting for the flight in progress.
+	abort     chan struct{}
+	closeOnce sync.Once
+	abortOnce sync.Once
+	// exited is closed when the loader goroutine returns.
+	exited   chan struct{}
 	done     *sync.WaitGroup
+	stats    *stats
+	key      string
+	observer Observer
+	// hedgeDelay and maxHedges configure hedged loader calls. Hedging is disabled unless both are positive.
+	hedgeDelay time.Duration
+	maxHedges  int
+	clock      clock.Clock
 }
 
-func (r *SingleRequestDataLoader[TRes]) Close() {
-	close(r.closeCh)
-	fmt.Println("Closing data loader...")
+// Close rejects new loads with ErrClosed. A flight that is already in progress may finish until ctx is done,
+// after which its subscribers receive ErrClosed, its loader call is cancelled, and Close returns ctx.Err().
+// Close returns once the loader goroutine has exited, but does not wait for a cancelled loader call to return.
+func (r *SingleRequestDataLoader[TRes]) Close(ctx context.Context) error {
+	r.closeOnce.Do(func() {
+		close(r.closeCh)
+	})
+	var err error
+	select {
+	case <-r.exited:
+	case <-ctx.Done():
+		r.abortOnce.Do(func() {
+			close(r.abort)
+		})
+		err = ctx.Err()
+	}
 	r.done.Wait()
-	fmt.Println("Data loader closed!")
+	return err
 }
 
-func NewSingleRequestDataLoader[TRes any](loader func(ctx context.Context) (TRes, error)) *SingleRequestDataLoader[TRes] {
-	requests := make(chan Request[TRes])
-	closeCh := make(chan struct{})
-	var done sync.WaitGroup
-
-	initLoader(requests, loader, closeCh, &done)
+func NewSingleRequestDataLoader[TRes any](loader func(ctx context.Context) (TRes, error), opts ...Option) *SingleRequestDataLoader[TRes] {
+	st := &stats{}
+	cfg := newConfig(opts)
+	guarded := guard(func(ctx context.Context, _ struct{}) (TRes, error) {
+		return loader(ctx)
+	}, cfg, st, newLimiter(cfg))
+	return newSingleRequestDataLoader(func(ctx context.Context) (TRes, error) {
+		return guarded(ctx, struct{}{})
+	}, "", cfg, st)
+}
 
-	return &SingleRequestDataLoader[TRes]{
-		requests: requests,
-		closeCh:  closeCh,
-		done:     &done,
+// newSingleRequestDataLoader creates the loader for key, which is empty unless the loader belongs to a MultiRequestDataLoader.
+func newSingleRequestDataLoader[TRes any](loader func(ctx context.Context) (TRes, error), key string, cfg config, st *stats) *SingleRequestDataLoader[TRes] {
+	r := &SingleRequestDataLoader[TRes]{
+		requests:    make(chan Request[TRes]),
+		unsubscribe: make(chan chan Result[TRes]),
+		closeCh:     make(chan struct{}),
+		abort:       make(chan struct{}),
+		exited:      make(chan struct{}),
+		done:        &sync.WaitGroup{},
+		stats:       st,
+		key:         key,
+		observer:    cfg.observer,
+		hedgeDelay:  cfg.hedgeDelay,
+		maxHedges:   cfg.maxHedges,
+		clock:       cfg.clock,
 	}
+	r.initLoader(loader)
+	return r
 }
 
-func initLoader[TRes any](requests chan Request[TRes], loader func(ctx context.Context) (TRes, error), closeCh chan struct{}, done *sync.WaitGroup) {
-	done.Add(1)
+func (r *SingleRequestDataLoader[TRes]) initLoader(loader func(ctx context.Context) (TRes, error)) {
+	r.done.Add(1)
 
 	go func() {
-		defer done.Done()
-		resp := make(chan Result[TRes], 1)
+		defer r.done.Done()
+		defer close(r.exited)
 		state := Idle
-		var subscribers []chan Result[TRes]
+		var current *flight[TRes]
+		// closing is set once Close has been called, and the loader goroutine only waits for the current flight.
+		closing := false
+		closeCh := r.closeCh
 
 		for {
 			switch state {
 			case Idle:
+				if closing {
+					return
+				}
+				// Prefer closing over starting a new flight.
 				select {
 				case <-closeCh:
 					return
-				case req := <-requests:
-					subscribers = append(subscribers, req.out)
+				default:
+				}
+				select {
+				case <-closeCh:
+					return
+				case req := <-r.requests:
+					r.stats.calls.Add(1)
+					r.stats.inFlight.Add(1)
+					current = r.startFlight(loader, req)
 					state = Loading
-					go func() {
-						value, err := loader(req.ctx)
-						resp <- Result[TRes]{
-							value: value,
-							err:   err,
-						}
-					}()
+				case <-r.unsubscribe:
+					// The subscriber's flight has already finished.
 				}
 			case Loading:
 				select {
-				case result := <-resp:
-					for _, sub := range subscribers {
+				case result := <-current.resp:
+					r.stats.inFlight.Add(-1)
+					if result.err != nil {
+						r.stats.errors.Add(1)
+					}
+					for _, sub := range current.subscribers {
 						sub <- result
 					}
 					// Reset
-					subscribers = nil
+					current.cancel()
+					current = nil
 					state = Idle
-				case req := <-requests:
-					subscribers = append(subscribers, req.out)
+				case req := <-r.requests:
+					if closing {
+						req.out <- Result[TRes]{err: ErrClosed}
+						continue
+					}
+					r.stats.coalesced.Add(1)
+					r.observer.OnCoalesced(req.ctx, r.key)
+					current.subscribers = append(current.subscribers, req.out)
+				case sub := <-r.unsubscribe:
+					if current.remove(sub) {
+						// Nobody is waiting for the result anymore, so cancel the loader and let the next request start a new flight.
+						r.stats.inFlight.Add(-1)
+						current.cancel()
+						current = nil
+						state = Idle
+					}
+				case <-closeCh:
+					closing = true
+					// A closed channel is always ready, so stop selecting on it.
+					closeCh = nil
+				case <-r.abort:
+					r.stats.inFlight.Add(-1)
+					for _, sub := range current.subscribers {
+						sub <- Result[TRes]{err: ErrClosed}
+					}
+					current.cancel()
+					return
 				}
 			}
 		}
 	}()
 }
 
+// Stats returns a snapshot of the loader's counters.
+func (r *SingleRequestDataLoader[TRes]) Stats() Stats {
+	return r.stats.snapshot()
+}
+
 func (r *SingleRequestDataLoader[TRes]) Load(ctx context.Context) (TRes, error) {
-	subscriber := make(chan Result[TRes])
+	// Buffered so that the loader goroutine never blocks on a subscriber that has gone away.
+	subscriber := make(chan Result[TRes], 1)
 	req := Request[TRes]{
 		ctx: ctx,
 		out: subscriber,
 	}
 	select {
-	case r.requests <- req:
 	case <-r.closeCh:
 		var zero TRes
-		return zero, errors.New("data loader is closed")
+		return zero, ErrClosed
+	default:
 	}
-	result := <-subscriber
-	if result.err != nil {
+	select {
+	case r.requests <- req:
+	case <-r.exited:
 		var zero TRes
-		return zero, result.err
+		return zero, ErrClosed
+	case <-ctx.Done():
+		var zero TRes
+		return zero, ctx.Err()
 	}
-	return result.value, nil
+
+	select {
+	case result := <-subscriber:
+		if result.err != nil {
+			var zero TRes
+			return zero, result.err
+		}
+		return result.value, nil
+	case <-ctx.Done():
+		select {
+		case r.unsubscribe <- subscriber:
+		case <-r.exited:
+		}
+		var zero TRes
+		return zero, ctx.Err()
+	}
+}
+
+// flight is a single call of the loader, shared by every subscriber that requested it while it was in progress.
+type flight[TRes any] struct {
+	resp        chan Result[TRes]
+	cancel      context.CancelFunc
+	subscribers []chan Result[TRes]
+}
+
+// startFlight calls loader in a new goroutine on behalf of req.
+// The loader's context keeps the values of req.ctx, but is only cancelled by flight.cancel.
+func (r *SingleRequestDataLoader[TRes]) startFlight(loader func(ctx context.Context) (TRes, error), req Request[TRes]) *flight[TRes] {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(req.ctx))
+	r.observer.OnLoadStart(ctx, r.key)
+	start := r.clock.Now()
+	f := &flight[TRes]{
+		// Buffered so that an abandoned flight's goroutine can still exit.
+		resp:        make(chan Result[TRes], 1),
+		cancel:      cancel,
+		subscribers: []chan Result[TRes]{req.out},
+	}
+	go func() {
+		value, err := r.callHedged(ctx, loader)
+		r.observer.OnLoadEnd(ctx, r.key, r.clock.Now().Sub(start), err)
+		f.resp <- Result[TRes]{
+			value: value,
+			err:   err,
+		}
+	}()
+	return f
+}
+
+// remove unsubscribes sub from the flight and reports whether no subscribers remain.
+func (f *flight[TRes]) remove(sub chan Result[TRes]) bool {
+	f.subscribers = slices.DeleteFunc(f.subscribers, func(s chan Result[TRes]) bool {
+		return s == sub
+	})
+	return len(f.subscribers) == 0
 }
 
 type LoaderState uint8
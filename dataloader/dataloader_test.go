@@ -0,0 +1,1827 @@
+package dataloader_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/clock"
+	"github.com/joshchoo/go-sandbox/dataloader"
+)
+
+type int64Arg int64
+
+func (a int64Arg) Arg() int64 {
+	return int64(a)
+}
+func (a int64Arg) Key() string {
+	return strconv.FormatInt(int64(a), 10)
+}
+
+type stringArg string
+
+func (a stringArg) Arg() string {
+	return string(a)
+}
+func (a stringArg) Key() string {
+	return string(a)
+}
+
+func TestBatchMultiRequestDataLoader(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	obs := newJoinObserver()
+	release := make(chan struct{})
+	var calls atomic.Int64
+	var batches [][]int64
+	var mu sync.Mutex
+	loader := dataloader.NewBatchMultiRequestDataLoader(func(ctx context.Context, args []int64) ([]int64, []error) {
+		calls.Add(1)
+		mu.Lock()
+		batches = append(batches, slices.Clone(args))
+		mu.Unlock()
+		<-release
+		res := make([]int64, len(args))
+		for i, arg := range args {
+			res[i] = arg * 2
+		}
+		return res, nil
+	}, dataloader.WithClock(clk), dataloader.WithBatchWindow(time.Hour), dataloader.WithMaxBatchSize(10), dataloader.WithObserver(obs))
+	defer loader.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := int64(i % 10)
+			res, err := loader.Load(context.Background(), int64Arg(key))
+			if err != nil {
+				t.Errorf("Expected no error, got %q", err)
+				return
+			}
+			if res != key*2 {
+				t.Errorf("Expected result %d, got %d", key*2, res)
+			}
+		}(i)
+	}
+	// Let every load join its key's flight before the batch returns.
+	obs.wait(30)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Fatalf("Expected batch loader to be called once, got %d", calls.Load())
+	}
+	if len(batches[0]) != 10 {
+		t.Errorf("Expected a batch of 10 distinct keys, got %v", batches[0])
+	}
+}
+
+func TestBatchMultiRequestDataLoaderWindow(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	var calls atomic.Int64
+	loader := dataloader.NewBatchMultiRequestDataLoader(func(ctx context.Context, args []int64) ([]int64, []error) {
+		calls.Add(1)
+		return args, nil
+	}, dataloader.WithClock(clk), dataloader.WithBatchWindow(20*time.Millisecond))
+	defer loader.Close(context.Background())
+
+	res := make(chan int64, 1)
+	go func() {
+		v, err := loader.Load(context.Background(), int64Arg(7))
+		if err != nil {
+			t.Errorf("Expected no error, got %q", err)
+		}
+		res <- v
+	}()
+
+	// The batch's window starts with its first load.
+	clk.BlockUntil(1)
+	clk.Advance(19 * time.Millisecond)
+	if calls.Load() != 0 {
+		t.Fatalf("Expected batch to wait for its window, got %d calls", calls.Load())
+	}
+	clk.Advance(time.Millisecond)
+	if v := <-res; v != 7 {
+		t.Errorf("Expected 7, got %d", v)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected batch loader to be called once, got %d", calls.Load())
+	}
+}
+
+func TestBatchMultiRequestDataLoaderMaxBatchSize(t *testing.T) {
+	var calls atomic.Int64
+	loader := dataloader.NewBatchMultiRequestDataLoader(func(ctx context.Context, args []int64) ([]int64, []error) {
+		calls.Add(1)
+		if len(args) > 4 {
+			t.Errorf("Expected at most 4 keys per batch, got %d", len(args))
+		}
+		return args, nil
+	}, dataloader.WithBatchWindow(time.Hour), dataloader.WithMaxBatchSize(4))
+	defer loader.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := loader.Load(context.Background(), int64Arg(i)); err != nil {
+				t.Errorf("Expected no error, got %q", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if calls.Load() != 2 {
+		t.Errorf("Expected batch loader to be called twice, got %d", calls.Load())
+	}
+}
+
+func TestBatchMultiRequestDataLoaderCancelledPendingBatch(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	obs := newLoadEndObserver()
+	loader := dataloader.NewBatchMultiRequestDataLoader(func(ctx context.Context, args []int64) ([]int64, []error) {
+		if err := ctx.Err(); err != nil {
+			errs := make([]error, len(args))
+			for i := range errs {
+				errs[i] = err
+			}
+			return nil, errs
+		}
+		return args, nil
+	}, dataloader.WithClock(clk), dataloader.WithBatchWindow(20*time.Millisecond), dataloader.WithObserver(obs))
+	defer loader.Close(context.Background())
+
+	// The only load of a pending batch gives up inside the window.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := loader.Load(ctx, int64Arg(1))
+		errs <- err
+	}()
+	clk.BlockUntil(1)
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected %q, got %q", context.Canceled, err)
+	}
+	<-obs.ended
+	if pending := clk.Pending(); pending != 0 {
+		t.Fatalf("Expected the abandoned batch's timer to be stopped, got %d pending timers", pending)
+	}
+
+	res := make(chan int64, 1)
+	go func() {
+		v, err := loader.Load(context.Background(), int64Arg(2))
+		if err != nil {
+			t.Errorf("Expected a later load to start a new batch, got %q", err)
+		}
+		res <- v
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(20 * time.Millisecond)
+	if v := <-res; v != 2 {
+		t.Errorf("Expected 2, got %d", v)
+	}
+}
+
+func TestBatchMultiRequestDataLoaderErrors(t *testing.T) {
+	errOdd := errors.New("odd key")
+	testCases := []struct {
+		name        string
+		batchLoader func(ctx context.Context, args []int64) ([]int64, []error)
+		key         int64
+		expRes      int64
+		expErr      error
+		expAnyErr   bool
+	}{
+		{
+			name: "per key error",
+			batchLoader: func(ctx context.Context, args []int64) ([]int64, []error) {
+				errs := make([]error, len(args))
+				for i, arg := range args {
+					if arg%2 == 1 {
+						errs[i] = errOdd
+					}
+				}
+				return args, errs
+			},
+			key:    3,
+			expErr: errOdd,
+		},
+		{
+			name: "per key success",
+			batchLoader: func(ctx context.Context, args []int64) ([]int64, []error) {
+				return args, make([]error, len(args))
+			},
+			key:    2,
+			expRes: 2,
+		},
+		{
+			name: "values omitted",
+			batchLoader: func(ctx context.Context, args []int64) ([]int64, []error) {
+				errs := make([]error, len(args))
+				for i := range errs {
+					errs[i] = errOdd
+				}
+				return nil, errs
+			},
+			key:    1,
+			expErr: errOdd,
+		},
+		{
+			name: "mismatched result count",
+			batchLoader: func(ctx context.Context, args []int64) ([]int64, []error) {
+				return args[1:], nil
+			},
+			key:       1,
+			expAnyErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			loader := dataloader.NewBatchMultiRequestDataLoader(tc.batchLoader, dataloader.WithMaxBatchSize(1))
+			defer loader.Close(context.Background())
+
+			res, err := loader.Load(context.Background(), int64Arg(tc.key))
+			if tc.expAnyErr {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				return
+			}
+			if !errors.Is(err, tc.expErr) {
+				t.Errorf("Expected error to be %q, got %q", tc.expErr, err)
+			}
+			if res != tc.expRes {
+				t.Errorf("Expected result %d, got %d", tc.expRes, res)
+			}
+		})
+	}
+}
+
+func TestMultiRequestDataLoaderCache(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	var calls atomic.Int64
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		return arg, nil
+	}, dataloader.WithClock(clk), dataloader.WithCache(time.Minute))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := loader.Load(ctx, int64Arg(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("Expected loader to be called once, got %d", calls.Load())
+	}
+
+	clk.Advance(time.Minute)
+	if _, err := loader.Load(ctx, int64Arg(1)); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("Expected expired result to be reloaded, got %d calls", calls.Load())
+	}
+}
+
+func TestMultiRequestDataLoaderPrimeAndClear(t *testing.T) {
+	var calls atomic.Int64
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		return arg, nil
+	}, dataloader.WithCache(0))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	loader.Prime("1", 100)
+	res, err := loader.Load(ctx, int64Arg(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 100 || calls.Load() != 0 {
+		t.Fatalf("Expected primed result 100 without calling the loader, got %d after %d calls", res, calls.Load())
+	}
+
+	loader.Clear("1")
+	res, err = loader.Load(ctx, int64Arg(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != 1 || calls.Load() != 1 {
+		t.Fatalf("Expected cleared key to be reloaded, got %d after %d calls", res, calls.Load())
+	}
+
+	loader.Load(ctx, int64Arg(2))
+	loader.ClearAll()
+	loader.Load(ctx, int64Arg(1))
+	loader.Load(ctx, int64Arg(2))
+	if calls.Load() != 4 {
+		t.Fatalf("Expected every key to be reloaded after ClearAll, got %d calls", calls.Load())
+	}
+}
+
+func TestMultiRequestDataLoaderCacheSkipsErrors(t *testing.T) {
+	var calls atomic.Int64
+	errLoad := errors.New("load failed")
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		return 0, errLoad
+	}, dataloader.WithCache(time.Minute))
+	defer loader.Close(context.Background())
+
+	for i := 0; i < 2; i++ {
+		if _, err := loader.Load(context.Background(), int64Arg(1)); !errors.Is(err, errLoad) {
+			t.Fatalf("Expected error %q, got %q", errLoad, err)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("Expected errors not to be cached, got %d calls", calls.Load())
+	}
+}
+
+// staleReadCache misses on the next Get after a Set, like a read that raced with the Set.
+type staleReadCache struct {
+	*dataloader.MemoryCache[int64]
+	stale atomic.Bool
+}
+
+func (c *staleReadCache) Get(ctx context.Context, key string) (dataloader.CacheEntry[int64], bool, error) {
+	if c.stale.CompareAndSwap(true, false) {
+		return dataloader.CacheEntry[int64]{}, false, nil
+	}
+	return c.MemoryCache.Get(ctx, key)
+}
+
+func (c *staleReadCache) Set(ctx context.Context, key string, entry dataloader.CacheEntry[int64]) error {
+	defer c.stale.Store(true)
+	return c.MemoryCache.Set(ctx, key, entry)
+}
+
+func TestMultiRequestDataLoaderCacheRaceWithFlight(t *testing.T) {
+	var calls atomic.Int64
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		return arg, nil
+	}, dataloader.WithCache(time.Minute), dataloader.WithCacheBackend[int64](&staleReadCache{MemoryCache: dataloader.NewMemoryCache[int64]()}))
+	defer loader.Close(context.Background())
+
+	for i := 0; i < 2; i++ {
+		if _, err := loader.Load(context.Background(), int64Arg(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("Expected a load that missed the cache to find the result of the previous flight, got %d calls", calls.Load())
+	}
+}
+
+// slowSetCache blocks Sets of key until release is closed, like a backend doing slow I/O.
+type slowSetCache struct {
+	*dataloader.MemoryCache[int64]
+	key     string
+	setting chan struct{}
+	release chan struct{}
+}
+
+func (c *slowSetCache) Set(ctx context.Context, key string, entry dataloader.CacheEntry[int64]) error {
+	if key == c.key {
+		close(c.setting)
+		<-c.release
+	}
+	return c.MemoryCache.Set(ctx, key, entry)
+}
+
+func TestMultiRequestDataLoaderSlowCacheBackend(t *testing.T) {
+	backend := &slowSetCache{
+		MemoryCache: dataloader.NewMemoryCache[int64](),
+		key:         "1",
+		setting:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return arg, nil
+	}, dataloader.WithCache(time.Minute), dataloader.WithCacheBackend[int64](backend))
+	defer loader.Close(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		loader.Load(context.Background(), int64Arg(1))
+	}()
+	<-backend.setting
+
+	// Storing the result of another key does not wait for the slow Set.
+	loaded := make(chan struct{})
+	go func() {
+		defer close(loaded)
+		loader.Load(context.Background(), int64Arg(2))
+	}()
+	select {
+	case <-loaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a load of another key not to wait for a slow cache write")
+	}
+	close(backend.release)
+	<-done
+}
+
+func TestMultiRequestDataLoaderMaxLoaders(t *testing.T) {
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return arg, nil
+	}, dataloader.WithMaxLoaders(3), dataloader.WithShards(1))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if _, err := loader.Load(ctx, int64Arg(i)); err != nil {
+			t.Fatal(err)
+		}
+		if loader.Len() > 3 {
+			t.Fatalf("Expected at most 3 loaders, got %d", loader.Len())
+		}
+	}
+	if loader.Len() != 3 {
+		t.Fatalf("Expected 3 loaders, got %d", loader.Len())
+	}
+}
+
+func TestMultiRequestDataLoaderMaxLoadersSharded(t *testing.T) {
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return arg, nil
+	}, dataloader.WithMaxLoaders(10), dataloader.WithShards(4))
+	defer loader.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := loader.Load(context.Background(), int64Arg(i)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := loader.Len(); n == 0 || n > 10 {
+		t.Fatalf("Expected between 1 and 10 loaders, got %d", n)
+	}
+}
+
+func TestMultiRequestDataLoaderIdleTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return arg, nil
+	}, dataloader.WithClock(clk), dataloader.WithIdleTimeout(time.Minute))
+	defer loader.Close(context.Background())
+
+	for i := 0; i < 5; i++ {
+		if _, err := loader.Load(context.Background(), int64Arg(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loader.Len() != 5 {
+		t.Fatalf("Expected 5 loaders, got %d", loader.Len())
+	}
+
+	// The loaders are swept every 30s. The sweep at 30s keeps them, and the sweep at 90s evicts them.
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1)
+	if loader.Len() != 5 {
+		t.Fatalf("Expected loaders idle for 30s to be kept, got %d", loader.Len())
+	}
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1)
+	if loader.Len() != 0 {
+		t.Fatalf("Expected idle loaders to be evicted, got %d", loader.Len())
+	}
+}
+
+func TestSingleRequestDataLoaderCallerCancellation(t *testing.T) {
+	obs := newJoinObserver()
+	release := make(chan struct{})
+	loaderErr := make(chan error, 1)
+	loader := dataloader.NewSingleRequestDataLoader(func(ctx context.Context) (int64, error) {
+		select {
+		case <-release:
+			loaderErr <- ctx.Err()
+			return 42, nil
+		case <-ctx.Done():
+			loaderErr <- ctx.Err()
+			return 0, ctx.Err()
+		}
+	}, dataloader.WithObserver(obs))
+	defer loader.Close(context.Background())
+
+	impatientCtx, cancel := context.WithCancel(context.Background())
+	impatientErr := make(chan error, 1)
+	go func() {
+		_, err := loader.Load(impatientCtx)
+		impatientErr <- err
+	}()
+	patientRes := make(chan int64, 1)
+	go func() {
+		res, err := loader.Load(context.Background())
+		if err != nil {
+			t.Errorf("Expected no error, got %q", err)
+		}
+		patientRes <- res
+	}()
+
+	obs.wait(2)
+	cancel()
+	if err := <-impatientErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancelled caller to return %q, got %q", context.Canceled, err)
+	}
+
+	close(release)
+	if res := <-patientRes; res != 42 {
+		t.Errorf("Expected remaining caller to receive 42, got %d", res)
+	}
+	if err := <-loaderErr; err != nil {
+		t.Errorf("Expected loader context not to be cancelled, got %q", err)
+	}
+}
+
+func TestSingleRequestDataLoaderAllCallersCancelled(t *testing.T) {
+	obs := newJoinObserver()
+	loaderErr := make(chan error, 1)
+	loader := dataloader.NewSingleRequestDataLoader(func(ctx context.Context) (int64, error) {
+		<-ctx.Done()
+		loaderErr <- ctx.Err()
+		return 0, ctx.Err()
+	}, dataloader.WithObserver(obs))
+	defer loader.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := loader.Load(ctx); !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected %q, got %q", context.Canceled, err)
+			}
+		}()
+	}
+
+	obs.wait(3)
+	cancel()
+	wg.Wait()
+
+	select {
+	case err := <-loaderErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected loader context to be cancelled, got %q", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected loader context to be cancelled once every caller has gone away")
+	}
+}
+
+func TestSingleRequestDataLoaderPanic(t *testing.T) {
+	obs := newJoinObserver()
+	release := make(chan struct{})
+	var calls atomic.Int64
+	errBoom := errors.New("boom")
+	loader := dataloader.NewSingleRequestDataLoader(func(ctx context.Context) (int64, error) {
+		if calls.Add(1) == 1 {
+			<-release
+			panic(errBoom)
+		}
+		return 42, nil
+	}, dataloader.WithObserver(obs))
+	defer loader.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := loader.Load(context.Background())
+			var panicErr *dataloader.PanicError
+			if !errors.As(err, &panicErr) {
+				t.Errorf("Expected *dataloader.PanicError, got %q", err)
+				return
+			}
+			if !errors.Is(err, errBoom) || len(panicErr.Stack) == 0 {
+				t.Errorf("Expected panic error to wrap %q with a stack trace, got %q", errBoom, err)
+			}
+		}()
+	}
+	obs.wait(3)
+	close(release)
+	wg.Wait()
+
+	res, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Expected loader to recover after a panic, got %q", err)
+	}
+	if res != 42 {
+		t.Errorf("Expected result 42, got %d", res)
+	}
+}
+
+func TestBatchMultiRequestDataLoaderPanic(t *testing.T) {
+	loader := dataloader.NewBatchMultiRequestDataLoader(func(ctx context.Context, args []int64) ([]int64, []error) {
+		panic("boom")
+	}, dataloader.WithMaxBatchSize(1))
+	defer loader.Close(context.Background())
+
+	var panicErr *dataloader.PanicError
+	if _, err := loader.Load(context.Background(), int64Arg(1)); !errors.As(err, &panicErr) {
+		t.Fatalf("Expected *dataloader.PanicError, got %q", err)
+	}
+	if panicErr.Value != "boom" {
+		t.Errorf("Expected panic value %q, got %v", "boom", panicErr.Value)
+	}
+}
+
+func TestMultiRequestDataLoaderStats(t *testing.T) {
+	obs := newJoinObserver()
+	errOdd := errors.New("odd key")
+	release := make(chan struct{})
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		<-release
+		if arg%2 == 1 {
+			return 0, errOdd
+		}
+		return arg, nil
+	}, dataloader.WithCache(time.Minute), dataloader.WithObserver(obs))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			loader.Load(ctx, int64Arg(i%2))
+		}(i)
+	}
+	obs.wait(6)
+	if inFlight := loader.Stats().InFlight; inFlight != 2 {
+		t.Errorf("Expected 2 keys in flight, got %d", inFlight)
+	}
+	close(release)
+	wg.Wait()
+	loader.Load(ctx, int64Arg(0))
+
+	exp := dataloader.Stats{
+		Calls:       2,
+		Coalesced:   4,
+		InFlight:    0,
+		CacheHits:   1,
+		CacheMisses: 6,
+		Errors:      1,
+	}
+	if stats := loader.Stats(); stats != exp {
+		t.Errorf("Expected stats %+v, got %+v", exp, stats)
+	}
+}
+
+// joinObserver sends on joined whenever a load starts a loader call or joins one in flight,
+// so that tests can wait for callers to be subscribed before letting the loader return.
+// It passes every event on to the embedded Observer.
+type joinObserver struct {
+	dataloader.Observer
+	joined chan struct{}
+}
+
+func newJoinObserver() *joinObserver {
+	return &joinObserver{
+		Observer: dataloader.NopObserver{},
+		joined:   make(chan struct{}, 100),
+	}
+}
+
+func (o *joinObserver) OnLoadStart(ctx context.Context, key string) {
+	o.Observer.OnLoadStart(ctx, key)
+	o.joined <- struct{}{}
+}
+
+func (o *joinObserver) OnCoalesced(ctx context.Context, key string) {
+	o.Observer.OnCoalesced(ctx, key)
+	o.joined <- struct{}{}
+}
+
+// wait blocks until n more loads have started or joined a loader call.
+func (o *joinObserver) wait(n int) {
+	for i := 0; i < n; i++ {
+		<-o.joined
+	}
+}
+
+// loadEndObserver sends on ended whenever a loader call finishes, including background refreshes.
+type loadEndObserver struct {
+	dataloader.NopObserver
+	ended chan struct{}
+}
+
+func newLoadEndObserver() *loadEndObserver {
+	return &loadEndObserver{ended: make(chan struct{}, 10)}
+}
+
+func (o *loadEndObserver) OnLoadEnd(ctx context.Context, key string, d time.Duration, err error) {
+	o.ended <- struct{}{}
+}
+
+func TestMultiRequestDataLoaderStaleWhileRevalidate(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	obs := newLoadEndObserver()
+	refreshing := make(chan struct{})
+	var calls atomic.Int64
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		n := calls.Add(1)
+		if n == 2 {
+			// Hold up the background refresh, so that stale loads can only return by not waiting for it.
+			<-refreshing
+		}
+		return n, nil
+	}, dataloader.WithClock(clk), dataloader.WithObserver(obs),
+		dataloader.WithCache(time.Minute), dataloader.WithStaleWhileRevalidate(10*time.Second))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	if res, _ := loader.Load(ctx, int64Arg(1)); res != 1 {
+		t.Fatalf("Expected first result 1, got %d", res)
+	}
+	<-obs.ended
+
+	clk.Advance(20 * time.Second)
+	for i := 0; i < 3; i++ {
+		if res, _ := loader.Load(ctx, int64Arg(1)); res != 1 {
+			t.Fatalf("Expected stale result 1, got %d", res)
+		}
+	}
+
+	close(refreshing)
+	<-obs.ended
+	if res, _ := loader.Load(ctx, int64Arg(1)); res != 2 {
+		t.Errorf("Expected refreshed result 2, got %d", res)
+	}
+	if refreshes := loader.Stats().Refreshes; refreshes != 1 {
+		t.Errorf("Expected 1 background refresh, got %d", refreshes)
+	}
+
+	// Once the hard TTL elapses, loads block on a fresh loader call.
+	clk.Advance(time.Minute)
+	if res, _ := loader.Load(ctx, int64Arg(1)); res != 3 {
+		t.Errorf("Expected reloaded result 3, got %d", res)
+	}
+}
+
+func TestMultiRequestDataLoaderRefreshAhead(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	obs := newLoadEndObserver()
+	var calls atomic.Int64
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return calls.Add(1), nil
+	}, dataloader.WithClock(clk), dataloader.WithObserver(obs),
+		dataloader.WithCache(time.Minute), dataloader.WithRefreshAhead(20*time.Second))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	loader.Load(ctx, int64Arg(1))
+	<-obs.ended
+
+	// Within 20s of expiry, a load serves the cached result and refreshes it in the background.
+	clk.Advance(45 * time.Second)
+	if res, _ := loader.Load(ctx, int64Arg(1)); res != 1 {
+		t.Fatalf("Expected cached result 1, got %d", res)
+	}
+	<-obs.ended
+	if res, _ := loader.Load(ctx, int64Arg(1)); res != 2 {
+		t.Fatalf("Expected refreshed result 2, got %d", res)
+	}
+
+	// The refreshed result outlives the original expiry.
+	clk.Advance(30 * time.Second)
+	if res, _ := loader.Load(ctx, int64Arg(1)); res != 2 {
+		t.Errorf("Expected refreshed result 2 to still be cached, got %d", res)
+	}
+}
+
+func TestSingleRequestDataLoaderRetry(t *testing.T) {
+	errTransient := errors.New("transient")
+	errPermanent := errors.New("permanent")
+	testCases := []struct {
+		name     string
+		errs     []error
+		expErr   error
+		expCalls int64
+	}{
+		{
+			name:     "succeeds after retries",
+			errs:     []error{errTransient, errTransient},
+			expCalls: 3,
+		},
+		{
+			name:     "gives up after max attempts",
+			errs:     []error{errTransient, errTransient, errTransient, errTransient},
+			expErr:   errTransient,
+			expCalls: 3,
+		},
+		{
+			name:     "does not retry non-retryable errors",
+			errs:     []error{errPermanent},
+			expErr:   errPermanent,
+			expCalls: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clk := clock.NewFake(time.Now())
+			obs := newJoinObserver()
+			var calls atomic.Int64
+			gate := make(chan struct{})
+			loader := dataloader.NewSingleRequestDataLoader(func(ctx context.Context) (int64, error) {
+				<-gate
+				n := calls.Add(1)
+				if int(n) <= len(tc.errs) {
+					return 0, tc.errs[n-1]
+				}
+				return 42, nil
+			}, dataloader.WithRetry(dataloader.RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     5 * time.Millisecond,
+				Retryable: func(err error) bool {
+					return errors.Is(err, errTransient)
+				},
+			}), dataloader.WithClock(clk), dataloader.WithObserver(obs))
+			defer loader.Close(context.Background())
+
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := loader.Load(context.Background()); !errors.Is(err, tc.expErr) {
+						t.Errorf("Expected error %q, got %q", tc.expErr, err)
+					}
+				}()
+			}
+			// Let every caller join the flight before the loader returns.
+			obs.wait(3)
+			close(gate)
+			// Backoffs are jittered, but never longer than MaxBackoff.
+			for i := int64(1); i < tc.expCalls; i++ {
+				clk.BlockUntil(1)
+				clk.Advance(5 * time.Millisecond)
+			}
+			wg.Wait()
+
+			if calls.Load() != tc.expCalls {
+				t.Errorf("Expected %d loader calls, got %d", tc.expCalls, calls.Load())
+			}
+		})
+	}
+}
+
+func TestMultiRequestDataLoaderCircuitBreaker(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	var calls atomic.Int64
+	var healthy atomic.Bool
+	errBackend := errors.New("backend unavailable")
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		if !healthy.Load() {
+			return 0, errBackend
+		}
+		return arg, nil
+	}, dataloader.WithClock(clk), dataloader.WithCircuitBreaker(3, time.Minute))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := loader.Load(ctx, int64Arg(i)); !errors.Is(err, errBackend) {
+			t.Fatalf("Expected %q, got %q", errBackend, err)
+		}
+	}
+	if _, err := loader.Load(ctx, int64Arg(3)); !errors.Is(err, dataloader.ErrCircuitOpen) {
+		t.Fatalf("Expected %q, got %q", dataloader.ErrCircuitOpen, err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("Expected open breaker to skip the loader, got %d calls", calls.Load())
+	}
+
+	// After the cooldown, a failed trial call opens the breaker again.
+	clk.Advance(time.Minute)
+	if _, err := loader.Load(ctx, int64Arg(4)); !errors.Is(err, errBackend) {
+		t.Fatalf("Expected trial call to fail with %q, got %q", errBackend, err)
+	}
+	if _, err := loader.Load(ctx, int64Arg(5)); !errors.Is(err, dataloader.ErrCircuitOpen) {
+		t.Fatalf("Expected %q, got %q", dataloader.ErrCircuitOpen, err)
+	}
+
+	// A successful trial call closes the breaker.
+	clk.Advance(time.Minute)
+	healthy.Store(true)
+	for i := 6; i < 9; i++ {
+		if _, err := loader.Load(ctx, int64Arg(i)); err != nil {
+			t.Fatalf("Expected no error, got %q", err)
+		}
+	}
+}
+
+func TestMultiRequestDataLoaderCircuitBreakerTrialPanics(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	var calls atomic.Int64
+	errBackend := errors.New("backend unavailable")
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		switch calls.Add(1) {
+		case 1:
+			return 0, errBackend
+		case 2:
+			panic("boom")
+		}
+		return arg, nil
+	}, dataloader.WithClock(clk), dataloader.WithCircuitBreaker(1, time.Minute))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	if _, err := loader.Load(ctx, int64Arg(0)); !errors.Is(err, errBackend) {
+		t.Fatalf("Expected %q, got %q", errBackend, err)
+	}
+
+	// A trial call that panics opens the breaker again.
+	clk.Advance(time.Minute)
+	var panicErr *dataloader.PanicError
+	if _, err := loader.Load(ctx, int64Arg(1)); !errors.As(err, &panicErr) {
+		t.Fatalf("Expected *dataloader.PanicError, got %q", err)
+	}
+	if _, err := loader.Load(ctx, int64Arg(2)); !errors.Is(err, dataloader.ErrCircuitOpen) {
+		t.Fatalf("Expected %q, got %q", dataloader.ErrCircuitOpen, err)
+	}
+
+	// After the next cooldown, another trial call is let through.
+	clk.Advance(time.Minute)
+	if res, err := loader.Load(ctx, int64Arg(3)); err != nil || res != 3 {
+		t.Fatalf("Expected 3, got %d (%v)", res, err)
+	}
+}
+
+func TestMultiRequestDataLoaderMaxConcurrency(t *testing.T) {
+	obs := newJoinObserver()
+	release := make(chan struct{})
+	var inFlight, maxInFlight, calls atomic.Int64
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+		return arg, nil
+	}, dataloader.WithMaxConcurrency(2), dataloader.WithObserver(obs))
+	defer loader.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := int64(i % 8)
+			if res, err := loader.Load(context.Background(), int64Arg(key)); err != nil || res != key {
+				t.Errorf("Expected %d, got %d (%v)", key, res, err)
+			}
+		}(i)
+	}
+	// Flights of queued keys start before they get a turn, so every load can join one.
+	obs.wait(40)
+	close(release)
+	wg.Wait()
+
+	if maxInFlight.Load() > 2 {
+		t.Errorf("Expected at most 2 concurrent loader calls, got %d", maxInFlight.Load())
+	}
+	// Loads of queued keys coalesce while they wait, so there is one call per key.
+	if calls.Load() != 8 {
+		t.Errorf("Expected queued loads to be coalesced into 8 calls, got %d", calls.Load())
+	}
+}
+
+func TestMultiRequestDataLoaderRateLimit(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return arg, nil
+	}, dataloader.WithClock(clk), dataloader.WithRateLimit(100, 1))
+	defer loader.Close(context.Background())
+
+	// The first load uses the burst.
+	if _, err := loader.Load(context.Background(), int64Arg(0)); err != nil {
+		t.Fatal(err)
+	}
+	// Each of the next loads waits 10ms for a token.
+	for i := 1; i < 6; i++ {
+		done := make(chan error, 1)
+		go func() {
+			_, err := loader.Load(context.Background(), int64Arg(i))
+			done <- err
+		}()
+		clk.BlockUntil(1)
+		clk.Advance(9 * time.Millisecond)
+		select {
+		case err := <-done:
+			t.Fatalf("Expected load %d to wait for a token, got %v", i, err)
+		default:
+		}
+		clk.Advance(time.Millisecond)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A load that gives up while waiting for a token returns its context error.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := loader.Load(ctx, int64Arg(6))
+		done <- err
+	}()
+	clk.BlockUntil(1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %q, got %q", context.Canceled, err)
+	}
+}
+
+func TestMultiRequestDataLoaderNegativeCache(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	errNotFound := errors.New("not found")
+	errTransient := errors.New("transient")
+	var calls atomic.Int64
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		switch arg {
+		case 1:
+			return 0, fmt.Errorf("user %d: %w", arg, errNotFound)
+		case 2:
+			return 0, errTransient
+		default:
+			return arg, nil
+		}
+	}, dataloader.WithClock(clk), dataloader.WithNegativeCache(time.Minute, errNotFound))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := loader.Load(ctx, int64Arg(1)); !errors.Is(err, errNotFound) {
+			t.Fatalf("Expected %q, got %q", errNotFound, err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("Expected not found error to be cached, got %d calls", calls.Load())
+	}
+
+	calls.Store(0)
+	for i := 0; i < 3; i++ {
+		if _, err := loader.Load(ctx, int64Arg(2)); !errors.Is(err, errTransient) {
+			t.Fatalf("Expected %q, got %q", errTransient, err)
+		}
+		loader.Load(ctx, int64Arg(3))
+	}
+	if calls.Load() != 6 {
+		t.Fatalf("Expected transient errors and values not to be cached, got %d calls", calls.Load())
+	}
+
+	calls.Store(0)
+	clk.Advance(time.Minute)
+	loader.Load(ctx, int64Arg(1))
+	if calls.Load() != 1 {
+		t.Fatalf("Expected not found error to expire, got %d calls", calls.Load())
+	}
+}
+
+func TestMultiRequestDataLoaderSharedCacheBackend(t *testing.T) {
+	var calls atomic.Int64
+	load := func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		return arg, nil
+	}
+	cache := dataloader.NewMemoryCache[int64]()
+	loader1 := dataloader.NewMultiRequestDataLoader(load, dataloader.WithCache(time.Minute), dataloader.WithCacheBackend[int64](cache))
+	defer loader1.Close(context.Background())
+	loader2 := dataloader.NewMultiRequestDataLoader(load, dataloader.WithCache(time.Minute), dataloader.WithCacheBackend[int64](cache))
+	defer loader2.Close(context.Background())
+
+	ctx := context.Background()
+	loader1.Load(ctx, int64Arg(1))
+	if res, err := loader2.Load(ctx, int64Arg(1)); err != nil || res != 1 {
+		t.Fatalf("Expected 1, got %d (%v)", res, err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("Expected loaders to share cached results, got %d calls", calls.Load())
+	}
+
+	loader2.ClearAll()
+	loader1.Load(ctx, int64Arg(1))
+	if calls.Load() != 2 {
+		t.Fatalf("Expected ClearAll to clear the shared backend, got %d calls", calls.Load())
+	}
+}
+
+// textCache stores errors as text, like a persistent Cache does.
+type textCache struct {
+	*dataloader.MemoryCache[int64]
+}
+
+func (c textCache) Set(ctx context.Context, key string, entry dataloader.CacheEntry[int64]) error {
+	if entry.Err != nil {
+		entry.Err = &dataloader.CachedError{Message: entry.Err.Error()}
+	}
+	return c.MemoryCache.Set(ctx, key, entry)
+}
+
+func TestMultiRequestDataLoaderPersistedNegativeCache(t *testing.T) {
+	errNotFound := errors.New("not found")
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return 0, fmt.Errorf("user %d: %w", arg, errNotFound)
+	}, dataloader.WithNegativeCache(time.Minute, errNotFound), dataloader.WithCacheBackend[int64](textCache{dataloader.NewMemoryCache[int64]()}))
+	defer loader.Close(context.Background())
+
+	ctx := context.Background()
+	loader.Load(ctx, int64Arg(1))
+	_, err := loader.Load(ctx, int64Arg(1))
+	var cachedErr *dataloader.CachedError
+	if !errors.As(err, &cachedErr) {
+		t.Fatalf("Expected a *CachedError, got %q", err)
+	}
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("Expected cached error %q to match %q", err, errNotFound)
+	}
+}
+
+func TestMultiRequestDataLoaderCacheBackendType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a cache backend of the wrong result type")
+		}
+	}()
+	dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return arg, nil
+	}, dataloader.WithCache(time.Minute), dataloader.WithCacheBackend[string](dataloader.NewMemoryCache[string]()))
+}
+
+func TestMultiRequestDataLoaderLoadMany(t *testing.T) {
+	obs := newJoinObserver()
+	release := make(chan struct{})
+	errOdd := errors.New("odd key")
+	var calls atomic.Int64
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		<-release
+		if arg%2 == 1 {
+			return 0, errOdd
+		}
+		return arg * 10, nil
+	}, dataloader.WithObserver(obs))
+	defer loader.Close(context.Background())
+
+	args := []dataloader.LoaderArg[int64]{int64Arg(4), int64Arg(1), int64Arg(2), int64Arg(4)}
+	var values []int64
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		values, errs = loader.LoadMany(context.Background(), args)
+	}()
+	// 3 calls start, and the second load of 4 joins the first.
+	obs.wait(4)
+	close(release)
+	<-done
+
+	expValues := []int64{40, 0, 20, 40}
+	expErrs := []error{nil, errOdd, nil, nil}
+	if !slices.Equal(values, expValues) {
+		t.Errorf("Expected values %v, got %v", expValues, values)
+	}
+	for i := range expErrs {
+		if !errors.Is(errs[i], expErrs[i]) {
+			t.Errorf("Expected error %d to be %q, got %q", i, expErrs[i], errs[i])
+		}
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected duplicate keys to be coalesced into 3 calls, got %d", calls.Load())
+	}
+}
+
+func TestMultiRequestDataLoaderLoadStream(t *testing.T) {
+	// Each key's loader call returns once its channel is closed, and the test closes them in key order.
+	release := map[int64]chan struct{}{1: make(chan struct{}), 2: make(chan struct{}), 3: make(chan struct{})}
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		<-release[arg]
+		return arg, nil
+	})
+	defer loader.Close(context.Background())
+
+	args := []dataloader.LoaderArg[int64]{int64Arg(3), int64Arg(1), int64Arg(2)}
+	var order []string
+	close(release[1])
+	for res := range loader.LoadStream(context.Background(), args) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if args[res.Index].Key() != res.Key || res.Value != args[res.Index].Arg() {
+			t.Errorf("Expected result for %s at index %d, got %+v", res.Key, res.Index, res)
+		}
+		order = append(order, res.Key)
+		if next, ok := release[res.Value+1]; ok {
+			close(next)
+		}
+	}
+
+	// Results arrive as soon as they are loaded, rather than in the order of args.
+	if exp := []string{"1", "2", "3"}; !slices.Equal(order, exp) {
+		t.Errorf("Expected results in order %v, got %v", exp, order)
+	}
+}
+
+func TestSingleRequestDataLoaderCloseDrainsInFlight(t *testing.T) {
+	obs := newJoinObserver()
+	release := make(chan struct{})
+	loader := dataloader.NewSingleRequestDataLoader(func(ctx context.Context) (int64, error) {
+		<-release
+		return 42, nil
+	}, dataloader.WithObserver(obs))
+
+	res := make(chan int64, 1)
+	go func() {
+		v, err := loader.Load(context.Background())
+		if err != nil {
+			t.Errorf("Expected in-flight load to finish, got %q", err)
+		}
+		res <- v
+	}()
+	obs.wait(1)
+
+	closeErr := make(chan error, 1)
+	go func() {
+		closeErr <- loader.Close(context.Background())
+	}()
+	close(release)
+	if err := <-closeErr; err != nil {
+		t.Fatalf("Expected Close to drain in-flight loads, got %q", err)
+	}
+	if v := <-res; v != 42 {
+		t.Errorf("Expected 42, got %d", v)
+	}
+	if _, err := loader.Load(context.Background()); !errors.Is(err, dataloader.ErrClosed) {
+		t.Errorf("Expected %q after Close, got %q", dataloader.ErrClosed, err)
+	}
+}
+
+func TestMultiRequestDataLoaderCloseDeadline(t *testing.T) {
+	obs := newJoinObserver()
+	loaderErr := make(chan error, 2)
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		<-ctx.Done()
+		loaderErr <- ctx.Err()
+		return 0, ctx.Err()
+	}, dataloader.WithObserver(obs))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := loader.Load(context.Background(), int64Arg(i%2)); !errors.Is(err, dataloader.ErrClosed) {
+				t.Errorf("Expected waiting load to fail with %q, got %q", dataloader.ErrClosed, err)
+			}
+		}(i)
+	}
+	obs.wait(4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := loader.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected Close to give up with %q, got %q", context.DeadlineExceeded, err)
+	}
+	wg.Wait()
+
+	if err := <-loaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected abandoned loader call to be cancelled, got %q", err)
+	}
+	if _, err := loader.Load(context.Background(), int64Arg(0)); !errors.Is(err, dataloader.ErrClosed) {
+		t.Errorf("Expected %q after Close, got %q", dataloader.ErrClosed, err)
+	}
+	if loader.Len() != 0 {
+		t.Errorf("Expected every per-key loader to be closed, got %d", loader.Len())
+	}
+}
+
+func TestMultiRequestDataLoaderCloseLeaksNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	clk := clock.NewFake(time.Now())
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return arg, nil
+	}, dataloader.WithClock(clk), dataloader.WithCache(time.Minute), dataloader.WithStaleWhileRevalidate(time.Millisecond), dataloader.WithIdleTimeout(time.Minute))
+	// The batch is dispatched once it holds every key, so the window never has to elapse.
+	batchLoader := dataloader.NewBatchMultiRequestDataLoader(func(ctx context.Context, args []int64) ([]int64, []error) {
+		return args, nil
+	}, dataloader.WithClock(clk), dataloader.WithBatchWindow(time.Hour), dataloader.WithMaxBatchSize(20))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			loader.Load(context.Background(), int64Arg(i%20))
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			batchLoader.Load(context.Background(), int64Arg(i))
+		}(i)
+	}
+	wg.Wait()
+	// Trigger background refreshes of stale results.
+	clk.Advance(5 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		loader.Load(context.Background(), int64Arg(i))
+	}
+
+	if err := loader.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := batchLoader.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForGoroutines(t, before)
+}
+
+func TestMultiRequestDataLoaderCloseDeadlineLeaksNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	obs := newJoinObserver()
+	release := make(chan struct{})
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		// The loader ignores cancellation, so it outlives Close.
+		<-release
+		return arg, nil
+	}, dataloader.WithObserver(obs))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			loader.Load(context.Background(), int64Arg(i%2))
+		}(i)
+	}
+	obs.wait(4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := loader.Close(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected Close to give up with %q, got %q", context.Canceled, err)
+	}
+	wg.Wait()
+
+	// Only the abandoned loader calls are left, and nothing else remains once they return.
+	close(release)
+	waitForGoroutines(t, before)
+}
+
+// waitForGoroutines fails the test unless the number of goroutines drops back to before within a second.
+func waitForGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("Expected %d goroutines after Close, got %d:\n%s", before, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) OnLoadStart(ctx context.Context, key string) {
+	o.record("start " + key)
+}
+
+func (o *recordingObserver) OnCoalesced(ctx context.Context, key string) {
+	o.record("coalesced " + key)
+}
+
+func (o *recordingObserver) OnLoadEnd(ctx context.Context, key string, d time.Duration, err error) {
+	if err != nil {
+		o.record("end " + key + " " + err.Error())
+		return
+	}
+	o.record("end " + key)
+}
+
+func (o *recordingObserver) OnEvict(key string, reason dataloader.EvictReason) {
+	o.record("evict " + key + " " + string(reason))
+}
+
+func TestMultiRequestDataLoaderObserver(t *testing.T) {
+	obs := &recordingObserver{}
+	joined := newJoinObserver()
+	joined.Observer = obs
+	release := make(chan struct{})
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		<-release
+		if arg == 2 {
+			return 0, errors.New("boom")
+		}
+		return arg, nil
+	}, dataloader.WithObserver(joined), dataloader.WithMaxLoaders(1))
+	defer loader.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loader.Load(context.Background(), int64Arg(1))
+		}()
+	}
+	joined.wait(2)
+	close(release)
+	wg.Wait()
+	loader.Load(context.Background(), int64Arg(2))
+
+	exp := []string{"start 1", "coalesced 1", "end 1", "start 2", "end 2 boom", "evict 1 lru"}
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if !slices.Equal(obs.events, exp) {
+		t.Errorf("Expected events %q, got %q", exp, obs.events)
+	}
+}
+
+func TestSlogObserver(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		return 0, errors.New("boom")
+	}, dataloader.WithObserver(dataloader.NewSlogObserver(logger)))
+	defer loader.Close(context.Background())
+
+	loader.Load(context.Background(), int64Arg(7))
+
+	out := buf.String()
+	for _, want := range []string{`msg="Data loader call started" key=7`, `level=ERROR msg="Data loader call failed" key=7`, "error=boom"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected log output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestSingleRequestDataLoaderHedging(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	var calls atomic.Int64
+	slowErr := make(chan error, 1)
+	loader := dataloader.NewSingleRequestDataLoader(func(ctx context.Context) (int64, error) {
+		n := calls.Add(1)
+		if n == 1 {
+			// The first call is stuck until it is cancelled.
+			<-ctx.Done()
+			slowErr <- ctx.Err()
+			return 0, ctx.Err()
+		}
+		return n, nil
+	}, dataloader.WithClock(clk), dataloader.WithHedging(10*time.Millisecond, 2))
+	defer loader.Close(context.Background())
+
+	done := make(chan int64, 1)
+	go func() {
+		v, err := loader.Load(context.Background())
+		if err != nil {
+			t.Errorf("Expected no error, got %q", err)
+		}
+		done <- v
+	}()
+	// The hedge timer is armed when the first call starts.
+	clk.BlockUntil(1)
+	clk.Advance(10 * time.Millisecond)
+	if res := <-done; res != 2 {
+		t.Errorf("Expected the hedged call's result 2, got %d", res)
+	}
+	if err := <-slowErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the slow call to be cancelled, got %q", err)
+	}
+	if hedges := loader.Stats().Hedges; hedges != 1 {
+		t.Errorf("Expected 1 hedged call, got %d", hedges)
+	}
+}
+
+func TestSingleRequestDataLoaderMaxHedges(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	var calls atomic.Int64
+	loader := dataloader.NewSingleRequestDataLoader(func(ctx context.Context) (int64, error) {
+		calls.Add(1)
+		started <- struct{}{}
+		<-release
+		return 42, nil
+	}, dataloader.WithClock(clk), dataloader.WithHedging(5*time.Millisecond, 2))
+	defer loader.Close(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		res, err := loader.Load(context.Background())
+		if err == nil && res != 42 {
+			err = fmt.Errorf("unexpected result %d", res)
+		}
+		done <- err
+	}()
+	<-started
+	for i := 0; i < 2; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(5 * time.Millisecond)
+		<-started
+	}
+	// No more hedges are scheduled once maxHedges is reached.
+	if pending := clk.Pending(); pending != 0 {
+		t.Errorf("Expected no hedge timer after 2 hedges, got %d", pending)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected 42, got %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 1 call and 2 hedges, got %d calls", calls.Load())
+	}
+}
+
+func TestKeyedDataLoader(t *testing.T) {
+	obs := newJoinObserver()
+	release := make(chan struct{})
+	var calls atomic.Int64
+	loader := dataloader.NewKeyedDataLoader(func(ctx context.Context, arg int64) (int64, error) {
+		calls.Add(1)
+		<-release
+		return arg * 2, nil
+	}, dataloader.WithCache(0), dataloader.WithObserver(obs))
+	defer loader.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := loader.Load(context.Background(), 21); err != nil || res != 42 {
+				t.Errorf("Expected 42, got %d, %v", res, err)
+			}
+		}()
+	}
+	obs.wait(10)
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Fatalf("Expected 1 call, got %d", calls.Load())
+	}
+
+	if err := loader.Prime(7, 70); err != nil {
+		t.Fatal(err)
+	}
+	values, errs := loader.LoadMany(context.Background(), []int64{7, 21})
+	if !slices.Equal(values, []int64{70, 42}) || errs[0] != nil || errs[1] != nil {
+		t.Errorf("Expected [70 42], got %v, %v", values, errs)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected cached values, got %d calls", calls.Load())
+	}
+}
+
+func TestKeyedDataLoaderStructArg(t *testing.T) {
+	type userKey struct {
+		Org string
+		ID  int
+	}
+	var calls atomic.Int64
+	loader := dataloader.NewKeyedDataLoader(func(ctx context.Context, arg userKey) (string, error) {
+		calls.Add(1)
+		return fmt.Sprintf("%s/%d", arg.Org, arg.ID), nil
+	}, dataloader.WithCache(0))
+	defer loader.Close(context.Background())
+
+	for _, arg := range []userKey{{"a", 1}, {"a", 1}, {"a b", 1}, {"a", 2}} {
+		if res, err := loader.Load(context.Background(), arg); err != nil || res != fmt.Sprintf("%s/%d", arg.Org, arg.ID) {
+			t.Errorf("Unexpected result for %v: %q, %v", arg, res, err)
+		}
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 calls, got %d", calls.Load())
+	}
+}
+
+func TestKeyedDataLoaderKeyCollisions(t *testing.T) {
+	type wrapper struct {
+		V any
+	}
+	var calls atomic.Int64
+	loader := dataloader.NewKeyedDataLoader(func(ctx context.Context, arg any) (any, error) {
+		calls.Add(1)
+		return arg, nil
+	}, dataloader.WithCache(0))
+	defer loader.Close(context.Background())
+
+	// Args that print the same but are not equal must not share a key, and equal args must.
+	args := []any{1, "1", int32(1), int64(1), 0.0, math.Copysign(0, -1), wrapper{1}, wrapper{int32(1)}, wrapper{"1"}, wrapper{1}}
+	for _, arg := range args {
+		if res, err := loader.Load(context.Background(), arg); err != nil || res != arg {
+			t.Errorf("Expected %#v, got %#v (%v)", arg, res, err)
+		}
+	}
+	if calls.Load() != 8 {
+		t.Errorf("Expected 8 calls, got %d", calls.Load())
+	}
+}
+
+func TestKeyFuncDataLoader(t *testing.T) {
+	type query struct {
+		Table string
+		ID    int64
+		// Trace does not affect the result, so it is not part of the key.
+		Trace string
+	}
+	var calls atomic.Int64
+	loader := dataloader.NewKeyFuncDataLoader(func(ctx context.Context, q query) (string, error) {
+		calls.Add(1)
+		return fmt.Sprintf("%s:%d", q.Table, q.ID), nil
+	}, func(q query) string {
+		return q.Table + ":" + strconv.FormatInt(q.ID, 10)
+	}, dataloader.WithCache(0))
+	defer loader.Close(context.Background())
+
+	for _, trace := range []string{"x", "y"} {
+		if _, err := loader.Load(context.Background(), query{"users", 1, trace}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 call, got %d", calls.Load())
+	}
+	if err := loader.Clear(query{Table: "users", ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loader.Load(context.Background(), query{Table: "users", ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected a reload after Clear, got %d calls", calls.Load())
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	var calls atomic.Int64
+	var loaders []*dataloader.MultiRequestDataLoader[string, string]
+	register := func(reg *dataloader.Registry) {
+		dataloader.Register(reg, "users", func() *dataloader.MultiRequestDataLoader[string, string] {
+			loader := dataloader.NewMultiRequestDataLoader(func(ctx context.Context, id string) (string, error) {
+				calls.Add(1)
+				return "user " + id, nil
+			}, dataloader.WithCache(0))
+			loaders = append(loaders, loader)
+			return loader
+		})
+	}
+	h := dataloader.RegistryHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loader, err := dataloader.LoaderFromContext[string, string](r.Context(), "users")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Fetching the loader again returns the same loader, with its cache.
+		for i := 0; i < 2; i++ {
+			loader, _ = dataloader.LoaderFromContext[string, string](r.Context(), "users")
+			res, err := loader.Load(r.Context(), stringArg(r.URL.Query().Get("id")))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			io.WriteString(w, res+"\n")
+		}
+	}), register)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?id=1", nil))
+		if exp := "user 1\nuser 1\n"; rec.Body.String() != exp {
+			t.Fatalf("Expected %q, got %q", exp, rec.Body.String())
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected the cache to last for one request, got %d calls", calls.Load())
+	}
+	for _, loader := range loaders {
+		if _, err := loader.Load(context.Background(), stringArg("1")); !errors.Is(err, dataloader.ErrClosed) {
+			t.Errorf("Expected the loaders to be closed after the request, got %v", err)
+		}
+	}
+}
+
+func TestRegistryHandlerHungLoad(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	register := func(reg *dataloader.Registry) {
+		dataloader.Register(reg, "users", func() *dataloader.MultiRequestDataLoader[string, string] {
+			return dataloader.NewMultiRequestDataLoader(func(ctx context.Context, id string) (string, error) {
+				close(started)
+				// Ignore ctx, like a backend call that hangs.
+				<-release
+				return "user " + id, nil
+			})
+		})
+	}
+	loadErr := make(chan error, 1)
+	h := dataloader.RegistryHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loader, err := dataloader.LoaderFromContext[string, string](r.Context(), "users")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Leave a load in flight once the request has been served.
+		go func() {
+			_, err := loader.Load(r.Context(), stringArg("1"))
+			loadErr <- err
+		}()
+		<-started
+	}), register)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The request's context is never cancelled.
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the handler to stop waiting for a hung load")
+	}
+	if err := <-loadErr; !errors.Is(err, dataloader.ErrClosed) {
+		t.Errorf("Expected the hung load to fail with %q, got %v", dataloader.ErrClosed, err)
+	}
+}
+
+func TestLoaderFromContextErrors(t *testing.T) {
+	if _, err := dataloader.LoaderFromContext[string, string](context.Background(), "users"); !errors.Is(err, dataloader.ErrNoRegistry) {
+		t.Errorf("Expected %q, got %v", dataloader.ErrNoRegistry, err)
+	}
+
+	reg := dataloader.NewRegistry()
+	dataloader.Register(reg, "users", func() *dataloader.MultiRequestDataLoader[string, string] {
+		return dataloader.NewMultiRequestDataLoader(func(ctx context.Context, id string) (string, error) {
+			return id, nil
+		})
+	})
+	ctx := dataloader.NewRegistryContext(context.Background(), reg)
+	if _, err := dataloader.LoaderFromContext[string, string](ctx, "posts"); err == nil {
+		t.Error("Expected an error for an unregistered loader")
+	}
+	if _, err := dataloader.LoaderFromContext[int64, string](ctx, "users"); err == nil {
+		t.Error("Expected an error for a loader of other types")
+	}
+	if err := reg.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataloader.LoaderFromContext[string, string](ctx, "users"); !errors.Is(err, dataloader.ErrClosed) {
+		t.Errorf("Expected %q, got %v", dataloader.ErrClosed, err)
+	}
+}
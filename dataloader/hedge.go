@@ -0,0 +1,47 @@
+package dataloader
+
+import (
+	"context"
+)
+
+// callHedged calls loader, and calls it again every hedgeDelay while no call has returned, up to maxHedges extra times.
+// It returns the result of whichever call returns first, and cancels the others.
+func (r *SingleRequestDataLoader[TRes]) callHedged(ctx context.Context, loader func(ctx context.Context) (TRes, error)) (TRes, error) {
+	if r.hedgeDelay <= 0 || r.maxHedges <= 0 {
+		return recoverPanic(func() (TRes, error) {
+			return loader(ctx)
+		})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Buffered so that the calls that lose the race can still exit.
+	results := make(chan Result[TRes], r.maxHedges+1)
+	call := func() {
+		value, err := recoverPanic(func() (TRes, error) {
+			return loader(ctx)
+		})
+		results <- Result[TRes]{
+			value: value,
+			err:   err,
+		}
+	}
+
+	go call()
+	hedges := 0
+	timer := r.clock.NewTimer(r.hedgeDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case res := <-results:
+			return res.value, res.err
+		case <-timer.C():
+			hedges++
+			r.stats.hedges.Add(1)
+			go call()
+			if hedges < r.maxHedges {
+				timer.Reset(r.hedgeDelay)
+			}
+		}
+	}
+}
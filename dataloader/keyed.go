@@ -0,0 +1,185 @@
+package dataloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// KeyedDataLoader is a MultiRequestDataLoader that derives each load's key from its arg,
+// so that args do not need to implement LoaderArg.
+type KeyedDataLoader[TArg any, TRes any] struct {
+	multi *MultiRequestDataLoader[TArg, TRes]
+	key   func(arg TArg) string
+}
+
+// NewKeyedDataLoader creates a KeyedDataLoader that coalesces loads of equal args.
+// Strings and integers are used as keys as they are. Other args are keyed by a representation of their value
+// that also tells apart values of different types held in interfaces, so that args share a key only if they are equal.
+// That key is also the key of cached results, as passed to a Cache backend.
+func NewKeyedDataLoader[TArg comparable, TRes any](loader func(ctx context.Context, arg TArg) (TRes, error), opts ...Option) *KeyedDataLoader[TArg, TRes] {
+	return NewKeyFuncDataLoader(loader, comparableKey[TArg], opts...)
+}
+
+// NewKeyFuncDataLoader creates a KeyedDataLoader that coalesces loads of args for which key returns the same key.
+func NewKeyFuncDataLoader[TArg any, TRes any](loader func(ctx context.Context, arg TArg) (TRes, error), key func(arg TArg) string, opts ...Option) *KeyedDataLoader[TArg, TRes] {
+	return &KeyedDataLoader[TArg, TRes]{
+		multi: NewMultiRequestDataLoader(loader, opts...),
+		key:   key,
+	}
+}
+
+// keyedArg adapts an arg and its derived key to LoaderArg.
+type keyedArg[TArg any] struct {
+	arg TArg
+	key string
+}
+
+func (a keyedArg[TArg]) Arg() TArg {
+	return a.arg
+}
+
+func (a keyedArg[TArg]) Key() string {
+	return a.key
+}
+
+func (r *KeyedDataLoader[TArg, TRes]) loaderArg(arg TArg) LoaderArg[TArg] {
+	return keyedArg[TArg]{arg: arg, key: r.key(arg)}
+}
+
+func (r *KeyedDataLoader[TArg, TRes]) loaderArgs(args []TArg) []LoaderArg[TArg] {
+	las := make([]LoaderArg[TArg], len(args))
+	for i, arg := range args {
+		las[i] = r.loaderArg(arg)
+	}
+	return las
+}
+
+// Load loads arg, coalescing with concurrent loads of the same key. See MultiRequestDataLoader.Load.
+func (r *KeyedDataLoader[TArg, TRes]) Load(ctx context.Context, arg TArg) (TRes, error) {
+	return r.multi.Load(ctx, r.loaderArg(arg))
+}
+
+// LoadMany loads every arg concurrently. See MultiRequestDataLoader.LoadMany.
+func (r *KeyedDataLoader[TArg, TRes]) LoadMany(ctx context.Context, args []TArg) ([]TRes, []error) {
+	return r.multi.LoadMany(ctx, r.loaderArgs(args))
+}
+
+// LoadStream loads every arg concurrently, and streams their results. See MultiRequestDataLoader.LoadStream.
+func (r *KeyedDataLoader[TArg, TRes]) LoadStream(ctx context.Context, args []TArg) <-chan KeyResult[TRes] {
+	return r.multi.LoadStream(ctx, r.loaderArgs(args))
+}
+
+// Prime stores value in the cache for arg. See MultiRequestDataLoader.Prime.
+func (r *KeyedDataLoader[TArg, TRes]) Prime(arg TArg, value TRes) error {
+	return r.multi.Prime(r.key(arg), value)
+}
+
+// Clear removes the cached result for arg, if any. See MultiRequestDataLoader.Clear.
+func (r *KeyedDataLoader[TArg, TRes]) Clear(arg TArg) error {
+	return r.multi.Clear(r.key(arg))
+}
+
+// ClearAll removes every cached result. See MultiRequestDataLoader.ClearAll.
+func (r *KeyedDataLoader[TArg, TRes]) ClearAll() error {
+	return r.multi.ClearAll()
+}
+
+// PeerHandler serves the loads forwarded by other processes. See MultiRequestDataLoader.PeerHandler.
+func (r *KeyedDataLoader[TArg, TRes]) PeerHandler() http.Handler {
+	return r.multi.PeerHandler()
+}
+
+// Stats returns a snapshot of the loader's counters, aggregated across keys.
+func (r *KeyedDataLoader[TArg, TRes]) Stats() Stats {
+	return r.multi.Stats()
+}
+
+// Len returns the number of per-key loaders that are currently running.
+func (r *KeyedDataLoader[TArg, TRes]) Len() int {
+	return r.multi.Len()
+}
+
+// Close rejects new loads with ErrClosed, and closes every per-key loader. See MultiRequestDataLoader.Close.
+func (r *KeyedDataLoader[TArg, TRes]) Close(ctx context.Context) error {
+	return r.multi.Close(ctx)
+}
+
+func comparableKey[TArg comparable](arg TArg) string {
+	v := reflect.ValueOf(&arg).Elem()
+	if v.Kind() == reflect.String {
+		return v.String()
+	}
+	return string(appendKey(nil, v))
+}
+
+// appendKey appends a representation of v to b that is the same for values exactly when they are equal (==).
+// NaNs are the exception, since they are not equal to themselves.
+func appendKey(b []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return append(b, "nil"...)
+		}
+		// Values of different types are never equal, even if they print the same.
+		e := v.Elem()
+		b = append(b, e.Type().String()...)
+		b = append(b, '(')
+		b = appendKey(b, e)
+		return append(b, ')')
+	case reflect.String:
+		return strconv.AppendQuote(b, v.String())
+	case reflect.Bool:
+		return strconv.AppendBool(b, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.AppendInt(b, v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.AppendUint(b, v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return appendFloatKey(b, v.Float(), v.Type().Bits())
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		bits := v.Type().Bits() / 2
+		b = append(b, '(')
+		b = appendFloatKey(b, real(c), bits)
+		b = append(b, ',')
+		b = appendFloatKey(b, imag(c), bits)
+		return append(b, ')')
+	case reflect.Pointer, reflect.Chan, reflect.UnsafePointer:
+		b = append(b, "0x"...)
+		return strconv.AppendUint(b, uint64(v.Pointer()), 16)
+	case reflect.Array:
+		b = append(b, '[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendKey(b, v.Index(i))
+		}
+		return append(b, ']')
+	case reflect.Struct:
+		b = append(b, '{')
+		for i := 0; i < v.NumField(); i++ {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, v.Type().Field(i).Name...)
+			b = append(b, ':')
+			b = appendKey(b, v.Field(i))
+		}
+		return append(b, '}')
+	default:
+		// Only an interface can hold a value that is not comparable, and comparing it would panic too.
+		panic(fmt.Sprintf("dataloader: arg of uncomparable type %s", v.Type()))
+	}
+}
+
+func appendFloatKey(b []byte, f float64, bits int) []byte {
+	if f == 0 {
+		// -0 is equal to 0.
+		f = 0
+	}
+	return strconv.AppendFloat(b, f, 'g', -1, bits)
+}
@@ -0,0 +1,106 @@
+package dataloader
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/clock"
+)
+
+// limiter bounds how many loader calls run at once and how often they start.
+type limiter struct {
+	// sem holds a token for every loader call in flight. It is nil if concurrency is unbounded.
+	sem chan struct{}
+	// bucket is nil if calls are not rate limited.
+	bucket *tokenBucket
+}
+
+// newLimiter returns the limiter configured in cfg, or nil if loader calls are not limited.
+func newLimiter(cfg config) *limiter {
+	if cfg.maxConcurrency <= 0 && cfg.rateLimit <= 0 {
+		return nil
+	}
+	l := &limiter{}
+	if cfg.maxConcurrency > 0 {
+		l.sem = make(chan struct{}, cfg.maxConcurrency)
+	}
+	if cfg.rateLimit > 0 {
+		l.bucket = newTokenBucket(cfg.rateLimit, cfg.rateBurst, cfg.clock)
+	}
+	return l
+}
+
+// acquire blocks until a loader call may start, and returns a func to call once it has finished.
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if l.sem != nil {
+			<-l.sem
+		}
+	}
+	if l.bucket != nil {
+		if err := l.bucket.wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// tokenBucket allows rate events per second on average, with bursts of up to burst events.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+	clock clock.Clock
+
+	mu sync.Mutex
+	// tokens goes negative while callers hold reservations for tokens that have not been refilled yet.
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, clk clock.Clock) *tokenBucket {
+	b := math.Max(float64(burst), 1)
+	return &tokenBucket{
+		rate:   rate,
+		burst:  b,
+		clock:  clk,
+		tokens: b,
+		last:   clk.Now(),
+	}
+}
+
+// wait reserves a token and blocks until it has been refilled.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := b.clock.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		// Hand the reservation back to the callers queued behind this one.
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,55 @@
+package dataloader
+
+import (
+	"context"
+	"sync"
+)
+
+// KeyResult is the result of loading one of the args passed to LoadStream.
+type KeyResult[TRes any] struct {
+	// Index is the position of the arg in the args passed to LoadStream.
+	Index int
+	Key   string
+	Value TRes
+	Err   error
+}
+
+// LoadMany loads every arg concurrently, and returns their values and errors in the same order as args.
+// Loads are coalesced with each other and with concurrent Loads as usual, so duplicate args are only loaded once.
+func (r *MultiRequestDataLoader[TArg, TRes]) LoadMany(ctx context.Context, args []LoaderArg[TArg]) ([]TRes, []error) {
+	values := make([]TRes, len(args))
+	errs := make([]error, len(args))
+	for res := range r.LoadStream(ctx, args) {
+		values[res.Index] = res.Value
+		errs[res.Index] = res.Err
+	}
+	return values, errs
+}
+
+// LoadStream loads every arg concurrently, and sends each result on the returned channel as soon as it is loaded.
+// The channel is closed once every arg has been loaded. It is buffered, so the caller may stop receiving early.
+func (r *MultiRequestDataLoader[TArg, TRes]) LoadStream(ctx context.Context, args []LoaderArg[TArg]) <-chan KeyResult[TRes] {
+	results := make(chan KeyResult[TRes], len(args))
+
+	var wg sync.WaitGroup
+	wg.Add(len(args))
+	for i, la := range args {
+		go func(i int, la LoaderArg[TArg]) {
+			defer wg.Done()
+			value, err := r.Load(ctx, la)
+			results <- KeyResult[TRes]{
+				Index: i,
+				Key:   la.Key(),
+				Value: value,
+				Err:   err,
+			}
+		}(i, la)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
@@ -0,0 +1,71 @@
+package dataloader
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// EvictReason is why a per-key loader was evicted.
+type EvictReason string
+
+const (
+	// EvictLRU means that the loader was the least recently used one when the WithMaxLoaders bound was exceeded.
+	EvictLRU EvictReason = "lru"
+	// EvictIdle means that the loader was not used for the WithIdleTimeout duration.
+	EvictIdle EvictReason = "idle"
+)
+
+// Observer is notified of a data loader's activity, e.g. for tracing and logging.
+// Keys are empty for a SingleRequestDataLoader created with NewSingleRequestDataLoader.
+// Methods are called synchronously from the loader's goroutines, so they must not block.
+type Observer interface {
+	// OnLoadStart is called when a loader call for key starts.
+	OnLoadStart(ctx context.Context, key string)
+	// OnCoalesced is called when a load of key joins a loader call that is already in flight.
+	OnCoalesced(ctx context.Context, key string)
+	// OnLoadEnd is called when a loader call for key returns, after d, with err if it failed.
+	OnLoadEnd(ctx context.Context, key string, d time.Duration, err error)
+	// OnEvict is called when the per-key loader for key is closed by eviction.
+	OnEvict(key string, reason EvictReason)
+}
+
+// NopObserver is an Observer that does nothing. Embed it to implement only some Observer methods.
+type NopObserver struct{}
+
+func (NopObserver) OnLoadStart(context.Context, string)                     {}
+func (NopObserver) OnCoalesced(context.Context, string)                     {}
+func (NopObserver) OnLoadEnd(context.Context, string, time.Duration, error) {}
+func (NopObserver) OnEvict(string, EvictReason)                             {}
+
+// SlogObserver is an Observer that logs loader activity to a *slog.Logger.
+// Loader calls that fail are logged at error level, and everything else at debug level.
+type SlogObserver struct {
+	logger *slog.Logger
+}
+
+func NewSlogObserver(logger *slog.Logger) *SlogObserver {
+	return &SlogObserver{
+		logger: logger,
+	}
+}
+
+func (o *SlogObserver) OnLoadStart(ctx context.Context, key string) {
+	o.logger.DebugContext(ctx, "Data loader call started", "key", key)
+}
+
+func (o *SlogObserver) OnCoalesced(ctx context.Context, key string) {
+	o.logger.DebugContext(ctx, "Data loader load coalesced", "key", key)
+}
+
+func (o *SlogObserver) OnLoadEnd(ctx context.Context, key string, d time.Duration, err error) {
+	if err != nil {
+		o.logger.ErrorContext(ctx, "Data loader call failed", "key", key, "duration", d, "error", err)
+		return
+	}
+	o.logger.DebugContext(ctx, "Data loader call finished", "key", key, "duration", d)
+}
+
+func (o *SlogObserver) OnEvict(key string, reason EvictReason) {
+	o.logger.Debug("Data loader evicted", "key", key, "reason", reason)
+}
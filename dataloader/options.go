@@ -0,0 +1,244 @@
+package dataloader
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/clock"
+)
+
+const defaultBatchWindow = 10 * time.Millisecond
+
+type config struct {
+	batchWindow  time.Duration
+	maxBatchSize int
+	cacheEnabled bool
+	cacheTTL     time.Duration
+	staleAfter   time.Duration
+	refreshAhead time.Duration
+	negativeTTL  time.Duration
+	notFound     []error
+	// cacheBackend is a Cache[TRes] for the loader's TRes, or nil for a MemoryCache.
+	cacheBackend any
+	maxLoaders   int
+	idleTimeout  time.Duration
+	shards       int
+
+	retry            RetryPolicy
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	maxConcurrency int
+	rateLimit      float64
+	rateBurst      int
+
+	observer Observer
+
+	hedgeDelay time.Duration
+	maxHedges  int
+
+	clock clock.Clock
+
+	// peers is nil unless loads are coalesced across processes.
+	peers *peerConfig
+}
+
+func newConfig(opts []Option) config {
+	cfg := config{
+		batchWindow: defaultBatchWindow,
+		observer:    NopObserver{},
+		clock:       clock.Real(),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// isNotFound reports whether err is one of the errors configured WithNegativeCache.
+func (c config) isNotFound(err error) bool {
+	return c.notFoundTarget(err) != nil
+}
+
+// notFoundTarget returns the WithNegativeCache error that err matches, if any.
+func (c config) notFoundTarget(err error) error {
+	for _, target := range c.notFound {
+		if errors.Is(err, target) {
+			return target
+		}
+	}
+	return nil
+}
+
+// notFoundMessage returns the WithNegativeCache error whose message is msg, if any.
+func (c config) notFoundMessage(msg string) error {
+	for _, target := range c.notFound {
+		if target.Error() == msg {
+			return target
+		}
+	}
+	return nil
+}
+
+// notFoundSuffix returns the WithNegativeCache error that msg ends with, if any.
+// It recovers the error of a not found result that was passed around as text.
+func (c config) notFoundSuffix(msg string) error {
+	for _, target := range c.notFound {
+		if strings.HasSuffix(msg, target.Error()) {
+			return target
+		}
+	}
+	return nil
+}
+
+// Option configures a MultiRequestDataLoader or SingleRequestDataLoader.
+// Options that concern keys, such as caching, batching and eviction, only apply to a MultiRequestDataLoader.
+type Option func(*config)
+
+// WithBatchWindow sets how long a batching loader waits for more keys after the first key of a batch arrives.
+func WithBatchWindow(d time.Duration) Option {
+	return func(c *config) {
+		c.batchWindow = d
+	}
+}
+
+// WithMaxBatchSize dispatches a batch as soon as it holds n keys, without waiting for the batch window to elapse.
+// A value of 0 means that batches are unbounded.
+func WithMaxBatchSize(n int) Option {
+	return func(c *config) {
+		c.maxBatchSize = n
+	}
+}
+
+// WithCache caches successful results by key, so that repeated loads of a key do not call the loader until ttl elapses.
+// A ttl of 0 means that results are cached until they are cleared.
+// Once ttl elapses, the next load of the key blocks on a fresh loader call.
+func WithCache(ttl time.Duration) Option {
+	return func(c *config) {
+		c.cacheEnabled = true
+		c.cacheTTL = ttl
+	}
+}
+
+// WithStaleWhileRevalidate serves cached results that are older than d immediately,
+// while reloading the key in the background through the usual coalescing path.
+// Results are still discarded once the WithCache ttl elapses, so d should be shorter than it.
+func WithStaleWhileRevalidate(d time.Duration) Option {
+	return func(c *config) {
+		c.staleAfter = d
+	}
+}
+
+// WithRefreshAhead reloads a key in the background when it is loaded within d of its WithCache ttl elapsing,
+// so that keys which are read frequently never expire.
+func WithRefreshAhead(d time.Duration) Option {
+	return func(c *config) {
+		c.refreshAhead = d
+	}
+}
+
+// WithNegativeCache caches loader errors that match one of notFound (as reported by errors.Is) for ttl,
+// so that repeated loads of a missing key do not call the loader. Other errors are never cached.
+// Not found errors are not retried, and do not count as failures towards the circuit breaker.
+func WithNegativeCache(ttl time.Duration, notFound ...error) Option {
+	return func(c *config) {
+		c.negativeTTL = ttl
+		c.notFound = notFound
+	}
+}
+
+// WithCacheBackend stores cached results in c instead of in a MemoryCache private to the loader.
+// It only selects where results are cached; use WithCache or WithNegativeCache to enable caching.
+// The loader's constructor panics if c does not store the loader's result type.
+func WithCacheBackend[TRes any](c Cache[TRes]) Option {
+	return func(cfg *config) {
+		cfg.cacheBackend = c
+	}
+}
+
+// WithMaxLoaders bounds the number of per-key loaders to n by closing the least recently used idle ones.
+// The bound is split between the loader's shards (see WithShards), and each shard evicts its own least recently used loaders.
+// A value of 0 means that per-key loaders are never evicted for exceeding the bound.
+func WithMaxLoaders(n int) Option {
+	return func(c *config) {
+		c.maxLoaders = n
+	}
+}
+
+// WithIdleTimeout closes per-key loaders that have not been used for d.
+// A value of 0 means that per-key loaders are never evicted for being idle.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.idleTimeout = d
+	}
+}
+
+// WithShards partitions the per-key loaders into n shards by a hash of their key, each with its own lock.
+// More shards let loads of distinct keys proceed with less contention, at the cost of a less exact LRU order WithMaxLoaders.
+// The default is 16 shards, and there are never more shards than WithMaxLoaders allows loaders.
+func WithShards(n int) Option {
+	return func(c *config) {
+		c.shards = n
+	}
+}
+
+// WithRetry retries failed loader calls according to p.
+func WithRetry(p RetryPolicy) Option {
+	return func(c *config) {
+		c.retry = p
+	}
+}
+
+// WithCircuitBreaker fails loads with ErrCircuitOpen for cooldown after threshold consecutive loader calls fail,
+// instead of calling the loader. The breaker is shared by every key of a MultiRequestDataLoader.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *config) {
+		c.breakerThreshold = threshold
+		c.breakerCooldown = cooldown
+	}
+}
+
+// WithMaxConcurrency bounds the number of loader calls in flight at once to n, across all keys.
+// Loads of a key that is waiting for its turn are still coalesced onto the queued call.
+// In batching mode, the limit applies to batch loader calls instead.
+func WithMaxConcurrency(n int) Option {
+	return func(c *config) {
+		c.maxConcurrency = n
+	}
+}
+
+// WithRateLimit limits loader calls to perSecond on average, allowing bursts of up to burst calls.
+// In batching mode, the limit applies to batch loader calls instead.
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(c *config) {
+		c.rateLimit = perSecond
+		c.rateBurst = burst
+	}
+}
+
+// WithObserver notifies o of the loader's activity.
+func WithObserver(o Observer) Option {
+	return func(c *config) {
+		c.observer = o
+	}
+}
+
+// WithHedging makes another loader call if a flight has not returned after delay, and again after every further delay,
+// up to maxHedges extra calls. The first call to return is delivered to every subscriber, and the others are cancelled.
+func WithHedging(delay time.Duration, maxHedges int) Option {
+	return func(c *config) {
+		c.hedgeDelay = delay
+		c.maxHedges = maxHedges
+	}
+}
+
+// WithClock makes the loader read the time and wait on timers through c, for batch windows, cache expiry,
+// idle eviction, retry backoff, the circuit breaker cooldown, rate limiting and hedging.
+// It is intended for tests, which can pass a *clock.Fake to control time.
+// Cache backends other than the loader's own MemoryCache keep reading the real time.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) {
+		cfg.clock = c
+	}
+}
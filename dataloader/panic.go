@@ -0,0 +1,39 @@
+package dataloader
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is returned to every caller waiting on a loader call that panicked.
+type PanicError struct {
+	// Value is the value that the loader passed to panic.
+	Value any
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("data loader panicked: %v\n\n%s", e.Value, e.Stack)
+}
+
+// Unwrap returns the panic value if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// recoverPanic calls fn, converting a panic into a *PanicError.
+func recoverPanic[TRes any](fn func() (TRes, error)) (res TRes, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			var zero TRes
+			res = zero
+			err = &PanicError{
+				Value: v,
+				Stack: debug.Stack(),
+			}
+		}
+	}()
+	return fn()
+}
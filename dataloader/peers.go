@@ -0,0 +1,290 @@
+package dataloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// peerErrorHeader marks a peer response whose body is the message of a loader error, rather than an encoded value.
+	peerErrorHeader = "Dataloader-Error"
+	// peerNotFoundHeader is set on an error response to the message of the WithNegativeCache error that the loader error matched.
+	peerNotFoundHeader = "Dataloader-Not-Found"
+)
+
+// peerRequest is the body of a load forwarded to a peer.
+type peerRequest struct {
+	Key string `json:"key"`
+	// Arg is encoded by the loader's arg codec.
+	Arg []byte `json:"arg"`
+}
+
+// PeerPath returns the path that loads are forwarded to by the loaders created WithPeers(name, ...),
+// and that each process must serve their PeerHandler at.
+func PeerPath(name string) string {
+	return "/dataloader/" + url.PathEscape(name)
+}
+
+// WithPeers makes a MultiRequestDataLoader coalesce loads with the loaders of the same name in other processes.
+// peers are the base URLs that the processes serve their PeerHandler on, either "http://host:port" or "unix:///path/to.sock",
+// and self is this process's entry in peers. Every process must be given the same peers.
+//
+// Each key is owned by one of the peers, elected by rendezvous hashing of the key, so that every process agrees on it.
+// Loads of keys owned by another peer are forwarded to it, with args and results encoded by argCodec and resCodec,
+// and coalesced with the loads of every other process there. If the owner cannot be reached, the key is loaded locally.
+// Loader errors are passed back as a *RemoteError.
+//
+// The loader's constructor panics if the codecs do not match its arg and result types, or if a peer is not a valid URL.
+func WithPeers[TArg any, TRes any](name, self string, peers []string, argCodec Codec[TArg], resCodec Codec[TRes]) Option {
+	return func(c *config) {
+		c.peers = &peerConfig{
+			name:     name,
+			self:     self,
+			addrs:    peers,
+			argCodec: argCodec,
+			resCodec: resCodec,
+		}
+	}
+}
+
+type peerConfig struct {
+	name  string
+	self  string
+	addrs []string
+	// argCodec and resCodec are a Codec[TArg] and Codec[TRes] for the loader's types.
+	argCodec any
+	resCodec any
+}
+
+// RemoteError is a loader error that was returned by the peer owning the key.
+// If the owner matched it to a WithNegativeCache error, it unwraps to the same error here, so that errors.Is still matches.
+type RemoteError struct {
+	Message string
+	target  error
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.target
+}
+
+// forwardedKey marks the context of a load that was forwarded by another peer, which must not be forwarded again.
+type forwardedKey struct{}
+
+// peerGroup forwards loads of keys owned by other processes.
+type peerGroup[TArg any, TRes any] struct {
+	name     string
+	self     string
+	peers    []peer
+	argCodec Codec[TArg]
+	resCodec Codec[TRes]
+	cfg      config
+}
+
+type peer struct {
+	addr string
+	// url is the URL that loads are forwarded to.
+	url    string
+	client *http.Client
+}
+
+func newPeerGroup[TArg any, TRes any](cfg config) *peerGroup[TArg, TRes] {
+	pc := cfg.peers
+	argCodec, ok := pc.argCodec.(Codec[TArg])
+	if !ok {
+		panic(fmt.Sprintf("dataloader: peer arg codec %T does not implement Codec[%T]", pc.argCodec, *new(TArg)))
+	}
+	resCodec, ok := pc.resCodec.(Codec[TRes])
+	if !ok {
+		panic(fmt.Sprintf("dataloader: peer result codec %T does not implement Codec[%T]", pc.resCodec, *new(TRes)))
+	}
+	g := &peerGroup[TArg, TRes]{
+		name:     pc.name,
+		self:     pc.self,
+		argCodec: argCodec,
+		resCodec: resCodec,
+		cfg:      cfg,
+	}
+	for _, addr := range pc.addrs {
+		g.peers = append(g.peers, newPeer(addr, PeerPath(pc.name)))
+	}
+	return g
+}
+
+func newPeer(addr, path string) peer {
+	if sock, ok := strings.CutPrefix(addr, "unix://"); ok {
+		var d net.Dialer
+		return peer{
+			addr: addr,
+			// The host is ignored, since every connection is dialled to sock.
+			url: "http://unix" + path,
+			client: &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return d.DialContext(ctx, "unix", sock)
+					},
+				},
+			},
+		}
+	}
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		panic(fmt.Sprintf("dataloader: invalid peer %q", addr))
+	}
+	return peer{
+		addr:   addr,
+		url:    strings.TrimSuffix(addr, "/") + path,
+		client: &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+	}
+}
+
+// owner returns the peer that owns key: the peer with the highest hash of its address and key.
+func (g *peerGroup[TArg, TRes]) owner(key string) peer {
+	var owner peer
+	var best uint64
+	for i, p := range g.peers {
+		h := fnv.New64a()
+		io.WriteString(h, p.addr)
+		h.Write([]byte{0})
+		io.WriteString(h, key)
+		if sum := mix64(h.Sum64()); i == 0 || sum > best {
+			owner, best = p, sum
+		}
+	}
+	return owner
+}
+
+// mix64 is the splitmix64 finalizer. FNV alone mixes the last bytes of similar addresses too weakly
+// for the highest hash to be spread evenly between the peers.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// forward loads key from its owner. ok is false if the key should be loaded locally instead,
+// because this process owns it, the load was forwarded here, or the owner could not be reached.
+func (g *peerGroup[TArg, TRes]) forward(ctx context.Context, key string, arg TArg, st *stats) (res TRes, err error, ok bool) {
+	owner := g.owner(key)
+	if owner.addr == g.self || ctx.Value(forwardedKey{}) != nil {
+		return res, nil, false
+	}
+	res, err, ok = g.call(ctx, owner, key, arg)
+	if ok {
+		st.forwards.Add(1)
+	} else if ctx.Err() == nil {
+		st.forwardFailures.Add(1)
+	}
+	return res, err, ok
+}
+
+func (g *peerGroup[TArg, TRes]) call(ctx context.Context, owner peer, key string, arg TArg) (res TRes, err error, ok bool) {
+	data, err := g.argCodec.Marshal(arg)
+	if err != nil {
+		return res, nil, false
+	}
+	body, err := json.Marshal(peerRequest{Key: key, Arg: data})
+	if err != nil {
+		return res, nil, false
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, owner.url, bytes.NewReader(body))
+	if err != nil {
+		return res, nil, false
+	}
+	resp, err := owner.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The caller gave up, so there is no point in loading locally either.
+			return res, ctx.Err(), true
+		}
+		return res, nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res, nil, false
+	}
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return res, nil, false
+	}
+	if resp.Header.Get(peerErrorHeader) != "" {
+		remoteErr := &RemoteError{Message: string(data)}
+		if notFound := resp.Header.Get(peerNotFoundHeader); notFound != "" {
+			remoteErr.target = g.cfg.notFoundMessage(notFound)
+		}
+		return res, remoteErr, true
+	}
+	res, err = g.resCodec.Unmarshal(data)
+	if err != nil {
+		return res, nil, false
+	}
+	return res, nil, true
+}
+
+func (g *peerGroup[TArg, TRes]) closeIdleConnections() {
+	for _, p := range g.peers {
+		p.client.CloseIdleConnections()
+	}
+}
+
+// PeerHandler serves the loads that other processes forward to this one, for a loader created WithPeers.
+// It must be served at PeerPath of the loader's name, on this process's peer address.
+func (r *MultiRequestDataLoader[TArg, TRes]) PeerHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.peers == nil {
+			http.NotFound(w, req)
+			return
+		}
+		var body peerRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		arg, err := r.peers.argCodec.Unmarshal(body.Arg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), forwardedKey{}, true)
+		res, err := r.Load(ctx, keyedArg[TArg]{arg: arg, key: body.Key})
+		switch {
+		case errors.Is(err, ErrClosed), errors.Is(err, ErrCircuitOpen):
+			// Let the caller load the key itself.
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			w.Header().Set(peerErrorHeader, "1")
+			if target := r.cfg.notFoundTarget(err); target != nil {
+				w.Header().Set(peerNotFoundHeader, target.Error())
+			}
+			io.WriteString(w, err.Error())
+			return
+		}
+		data, err := r.peers.resCodec.Marshal(res)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	})
+}
@@ -0,0 +1,299 @@
+package dataloader_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/dataloader"
+)
+
+var errPeerNotFound = errors.New("not found")
+
+// newPeerLoader creates a loader that coalesces with the other peers, and that records which peer loaded each key.
+func newPeerLoader(self string, peers []string, calls *atomic.Int64) *dataloader.KeyedDataLoader[string, string] {
+	return dataloader.NewKeyedDataLoader(func(ctx context.Context, key string) (string, error) {
+		calls.Add(1)
+		if strings.HasPrefix(key, "missing") {
+			return "", fmt.Errorf("key %s: %w", key, errPeerNotFound)
+		}
+		if strings.HasPrefix(key, "broken") {
+			// A transient error whose message happens to end like errPeerNotFound's.
+			return "", errors.New("upstream route not found")
+		}
+		return key + "@" + self, nil
+	},
+		dataloader.WithPeers("test", self, peers, dataloader.JSONCodec[string]{}, dataloader.JSONCodec[string]{}),
+		dataloader.WithCache(time.Minute),
+		dataloader.WithNegativeCache(time.Minute, errPeerNotFound),
+	)
+}
+
+func TestPeers(t *testing.T) {
+	var servers []*httptest.Server
+	var peers []string
+	for i := 0; i < 3; i++ {
+		srv := httptest.NewUnstartedServer(http.NewServeMux())
+		servers = append(servers, srv)
+		peers = append(peers, "http://"+srv.Listener.Addr().String())
+	}
+	var calls atomic.Int64
+	var loaders []*dataloader.KeyedDataLoader[string, string]
+	for i, srv := range servers {
+		loader := newPeerLoader(peers[i], peers, &calls)
+		defer loader.Close(context.Background())
+		srv.Config.Handler.(*http.ServeMux).Handle("POST "+dataloader.PeerPath("test"), loader.PeerHandler())
+		srv.Start()
+		defer srv.Close()
+		loaders = append(loaders, loader)
+	}
+
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	owners := make(map[string]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, loader := range loaders {
+		for _, key := range keys {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := loader.Load(context.Background(), key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				owner, _ := strings.CutPrefix(res, key+"@")
+				mu.Lock()
+				defer mu.Unlock()
+				if prev, ok := owners[key]; ok && prev != owner {
+					t.Errorf("Expected every peer to get %s from the same owner, got %s and %s", key, prev, owner)
+				}
+				owners[key] = owner
+			}()
+		}
+	}
+	wg.Wait()
+	if calls.Load() != int64(len(keys)) {
+		t.Errorf("Expected each key to be loaded once across peers, got %d calls", calls.Load())
+	}
+
+	// Not found errors survive the trip from the owner.
+	for _, loader := range loaders {
+		if _, err := loader.Load(context.Background(), "missing"); !errors.Is(err, errPeerNotFound) {
+			t.Errorf("Expected %q, got %q", errPeerNotFound, err)
+		}
+	}
+
+	// Other errors are not mistaken for not found errors by their message, so they are not cached.
+	before := calls.Load()
+	for _, loader := range loaders {
+		for i := 0; i < 2; i++ {
+			if _, err := loader.Load(context.Background(), "broken"); err == nil || errors.Is(err, errPeerNotFound) {
+				t.Errorf("Expected a transient error, got %v", err)
+			}
+		}
+	}
+	if n := calls.Load() - before; n != int64(2*len(loaders)) {
+		t.Errorf("Expected transient errors not to be cached, got %d calls for %d loads", n, 2*len(loaders))
+	}
+
+	// Forwarded loads must name their key.
+	for _, body := range []string{`{"arg": "ImEi"}`, `{"key": "", "arg": "ImEi"}`} {
+		rec := httptest.NewRecorder()
+		loaders[0].PeerHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, dataloader.PeerPath("test"), strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, rec.Code)
+		}
+	}
+
+	// Keys owned by a peer that is down are loaded locally.
+	servers[2].Close()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		res, err := loaders[0].Load(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(res, "@"+peers[2]) {
+			t.Fatalf("Expected %s not to be loaded by the closed peer, got %q", key, res)
+		}
+	}
+	if stats := loaders[0].Stats(); stats.ForwardFailures == 0 {
+		t.Errorf("Expected loads owned by the closed peer to fall back to local loading, got %+v", stats)
+	}
+}
+
+// TestPeerProcess is run by TestPeersAcrossProcesses in child processes, each of which is one of the peers.
+// It serves a peer loader on a Unix socket until its stdin is closed.
+func TestPeerProcess(t *testing.T) {
+	self := os.Getenv("DATALOADER_PEER_SELF")
+	if self == "" {
+		t.Skip("Only run as a child process of TestPeersAcrossProcesses")
+	}
+	peers := strings.Split(os.Getenv("DATALOADER_PEERS"), ",")
+
+	var calls atomic.Int64
+	loader := newPeerLoader(self, peers, &calls)
+	defer loader.Close(context.Background())
+
+	mux := http.NewServeMux()
+	mux.Handle("POST "+dataloader.PeerPath("test"), loader.PeerHandler())
+	mux.HandleFunc("GET /load/{key}", func(w http.ResponseWriter, r *http.Request) {
+		res, err := loader.Load(r.Context(), r.PathValue("key"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, res)
+	})
+	mux.HandleFunc("GET /calls", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, calls.Load())
+	})
+
+	listener, err := net.Listen("unix", strings.TrimPrefix(self, "unix://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	io.Copy(io.Discard, os.Stdin)
+}
+
+func TestPeersAcrossProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts child processes")
+	}
+	// Unix socket paths are limited to about 100 bytes, so keep them out of the test's long temp directory.
+	dir, err := os.MkdirTemp("", "dataloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var peers []string
+	for i := 0; i < 3; i++ {
+		peers = append(peers, "unix://"+filepath.Join(dir, fmt.Sprintf("peer%d.sock", i)))
+	}
+	var procs []*exec.Cmd
+	var clients []*http.Client
+	for _, self := range peers {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPeerProcess$")
+		cmd.Env = append(os.Environ(), "DATALOADER_PEER_SELF="+self, "DATALOADER_PEERS="+strings.Join(peers, ","))
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Wait()
+		defer stdin.Close()
+		procs = append(procs, cmd)
+
+		sock := strings.TrimPrefix(self, "unix://")
+		clients = append(clients, &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}})
+	}
+
+	get := func(peer int, path string) (string, error) {
+		resp, err := clients[peer].Get("http://unix" + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("GET %s: %s: %s", path, resp.Status, body)
+		}
+		return string(body), err
+	}
+	waitForPeer := func(peer int) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, err := get(peer, "/calls"); err == nil {
+				return
+			} else if time.Now().After(deadline) {
+				t.Fatalf("Peer %d did not start: %v", peer, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for i := range peers {
+		waitForPeer(i)
+	}
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	results := make([][]string, len(peers))
+	var wg sync.WaitGroup
+	for i := range peers {
+		results[i] = make([]string, len(keys))
+		for j, key := range keys {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := get(i, "/load/"+url.PathEscape(key))
+				if err != nil {
+					t.Error(err)
+				}
+				results[i][j] = res
+			}()
+		}
+	}
+	wg.Wait()
+
+	var total int
+	for i := range peers {
+		calls, err := get(i, "/calls")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		fmt.Sscan(calls, &n)
+		total += n
+	}
+	if total != len(keys) {
+		t.Errorf("Expected each key to be loaded once across processes, got %d calls", total)
+	}
+	for j, key := range keys {
+		for i := range peers {
+			if results[i][j] != results[0][j] {
+				t.Errorf("Expected every process to get the owner's result for %s, got %q and %q", key, results[0][j], results[i][j])
+			}
+		}
+	}
+
+	// Kill a peer, so that the keys it owns are loaded by the process asking for them.
+	if err := procs[2].Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	procs[2].Wait()
+	for j := 0; j < 20; j++ {
+		key := fmt.Sprintf("key-%d", j)
+		res, err := get(0, "/load/"+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(res, "@"+peers[2]) {
+			t.Fatalf("Expected %s not to be loaded by the killed peer, got %q", key, res)
+		}
+	}
+}
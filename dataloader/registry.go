@@ -0,0 +1,126 @@
+package dataloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNoRegistry is returned by LoaderFromContext when the context does not carry a Registry.
+var ErrNoRegistry = errors.New("no data loader registry in context")
+
+// Registry holds a set of named MultiRequestDataLoaders, e.g. for the lifetime of a single request.
+// Loaders are registered with a constructor, and only created the first time they are fetched.
+type Registry struct {
+	mu        sync.Mutex
+	factories map[string]func() any
+	loaders   map[string]registeredLoader
+	closed    bool
+}
+
+// registeredLoader is a *MultiRequestDataLoader of any type.
+type registeredLoader interface {
+	Close(ctx context.Context) error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		factories: make(map[string]func() any),
+		loaders:   make(map[string]registeredLoader),
+	}
+}
+
+// Register adds the loader created by newLoader to reg under name, replacing any loader registered under it before.
+func Register[TArg any, TRes any](reg *Registry, name string, newLoader func() *MultiRequestDataLoader[TArg, TRes]) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.factories[name] = func() any {
+		return newLoader()
+	}
+}
+
+// Loader returns the loader registered under name, creating it if it has not been fetched before.
+// It returns an error if no loader is registered under name, if the loader has other types, or if reg has been closed.
+func Loader[TArg any, TRes any](reg *Registry, name string) (*MultiRequestDataLoader[TArg, TRes], error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.closed {
+		return nil, ErrClosed
+	}
+	loader, ok := reg.loaders[name]
+	if !ok {
+		newLoader, ok := reg.factories[name]
+		if !ok {
+			return nil, fmt.Errorf("no data loader registered as %q", name)
+		}
+		loader = newLoader().(registeredLoader)
+		reg.loaders[name] = loader
+	}
+	typed, ok := loader.(*MultiRequestDataLoader[TArg, TRes])
+	if !ok {
+		return nil, fmt.Errorf("data loader %q is a %T, not a %T", name, loader, typed)
+	}
+	return typed, nil
+}
+
+// Close closes every loader that has been created, as MultiRequestDataLoader.Close does, and rejects fetching loaders after.
+func (reg *Registry) Close(ctx context.Context) error {
+	reg.mu.Lock()
+	reg.closed = true
+	loaders := reg.loaders
+	reg.loaders = make(map[string]registeredLoader)
+	reg.mu.Unlock()
+
+	var errs []error
+	for _, loader := range loaders {
+		if err := loader.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type registryKey struct{}
+
+// NewRegistryContext returns a copy of ctx that carries reg.
+func NewRegistryContext(ctx context.Context, reg *Registry) context.Context {
+	return context.WithValue(ctx, registryKey{}, reg)
+}
+
+// RegistryFromContext returns the Registry carried by ctx, if any.
+func RegistryFromContext(ctx context.Context) (*Registry, bool) {
+	reg, ok := ctx.Value(registryKey{}).(*Registry)
+	return reg, ok
+}
+
+// LoaderFromContext returns the loader registered under name in the Registry carried by ctx. See Loader.
+func LoaderFromContext[TArg any, TRes any](ctx context.Context, name string) (*MultiRequestDataLoader[TArg, TRes], error) {
+	reg, ok := RegistryFromContext(ctx)
+	if !ok {
+		return nil, ErrNoRegistry
+	}
+	return Loader[TArg, TRes](reg, name)
+}
+
+// registryCloseTimeout is how long RegistryHandler waits for loads still in flight once a request has been served.
+const registryCloseTimeout = time.Second
+
+// RegistryHandler is middleware that gives every request a new Registry, set up by register and carried by the request's context,
+// so that loads are only coalesced and cached within a request. The registry's loaders are closed once h has served the request,
+// waiting up to a second for loads still in flight, such as background refreshes.
+func RegistryHandler(h http.Handler, register func(reg *Registry)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reg := NewRegistry()
+		register(reg)
+		defer func() {
+			// The request's context is only cancelled after ServeHTTP returns, so it cannot bound Close.
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), registryCloseTimeout)
+			defer cancel()
+			reg.Close(ctx)
+		}()
+		h.ServeHTTP(w, r.WithContext(NewRegistryContext(r.Context(), reg)))
+	})
+}
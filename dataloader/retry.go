@@ -0,0 +1,193 @@
+package dataloader
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/clock"
+)
+
+// ErrCircuitOpen is returned without calling the loader while the loader's circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// RetryPolicy configures how failed loader calls are retried.
+// Retries happen within a single flight, so they are shared by every caller coalesced onto it.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of loader calls per flight, including the first. Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. It doubles after every retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries. A value of 0 means that the delay is uncapped.
+	MaxBackoff time.Duration
+	// Retryable reports whether err should be retried. If nil, every error is retried.
+	// Context errors and ErrCircuitOpen are never retried.
+	Retryable func(err error) bool
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// backoff returns the jittered delay before the given retry, counting from 1.
+// The delay is chosen uniformly between half and all of the exponential backoff.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// guard wraps loader with the retry policy and circuit breaker configured in cfg, and with lim if it is not nil.
+func guard[TArg any, TRes any](loader func(ctx context.Context, arg TArg) (TRes, error), cfg config, st *stats, lim *limiter) func(ctx context.Context, arg TArg) (TRes, error) {
+	var breaker *circuitBreaker
+	if cfg.breakerThreshold > 0 {
+		breaker = newCircuitBreaker(cfg.breakerThreshold, cfg.breakerCooldown, cfg.isNotFound, cfg.clock)
+	}
+	if breaker == nil && lim == nil && cfg.retry.MaxAttempts < 2 {
+		return loader
+	}
+
+	call := func(ctx context.Context, arg TArg) (TRes, error) {
+		if breaker != nil {
+			if err := breaker.allow(); err != nil {
+				var zero TRes
+				return zero, err
+			}
+		}
+		if lim != nil {
+			release, err := lim.acquire(ctx)
+			if err != nil {
+				if breaker != nil {
+					breaker.record(err)
+				}
+				var zero TRes
+				return zero, err
+			}
+			defer release()
+		}
+		if breaker != nil {
+			// A panic counts as a failure, and must not leave a half-open trial in progress forever.
+			defer func() {
+				if v := recover(); v != nil {
+					breaker.record(&PanicError{Value: v})
+					panic(v)
+				}
+			}()
+		}
+		res, err := loader(ctx, arg)
+		if breaker != nil {
+			breaker.record(err)
+		}
+		return res, err
+	}
+
+	return func(ctx context.Context, arg TArg) (TRes, error) {
+		for attempt := 1; ; attempt++ {
+			res, err := call(ctx, arg)
+			if err == nil || attempt >= cfg.retry.MaxAttempts || cfg.isNotFound(err) || !cfg.retry.retryable(err) {
+				return res, err
+			}
+			st.retries.Add(1)
+			timer := cfg.clock.NewTimer(cfg.retry.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return res, err
+			case <-timer.C():
+			}
+		}
+	}
+}
+
+type breakerState uint8
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker fails loader calls fast after threshold consecutive failures.
+// After cooldown, it lets a single trial call through, and closes again if the trial succeeds.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	// isNotFound reports errors that mean the backend is healthy, but the key is missing.
+	isNotFound func(err error) bool
+	clock      clock.Clock
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// trial is set while the half-open trial call is in progress.
+	trial bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, isNotFound func(err error) bool, clk clock.Clock) *circuitBreaker {
+	return &circuitBreaker{
+		threshold:  threshold,
+		cooldown:   cooldown,
+		isNotFound: isNotFound,
+		clock:      clk,
+	}
+}
+
+// allow returns ErrCircuitOpen if a loader call should not be made.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.clock.Now().Sub(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.trial = true
+		return nil
+	case breakerHalfOpen:
+		if b.trial {
+			return ErrCircuitOpen
+		}
+		b.trial = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// record updates the breaker with the outcome of an allowed loader call.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	switch {
+	case err == nil || b.isNotFound(err):
+		b.state = breakerClosed
+		b.failures = 0
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		// The caller gave up, which says nothing about the backend.
+	case b.state == breakerHalfOpen:
+		b.state = breakerOpen
+		b.openedAt = b.clock.Now()
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.state = breakerOpen
+			b.openedAt = b.clock.Now()
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package dataloader
+
+import (
+	"container/list"
+	"context"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultShards = 16
+
+// shard holds the per-key loaders of the keys that hash to it, so that loads of keys in different shards do not contend.
+// Each shard bounds and evicts its own loaders.
+type shard[TRes any] struct {
+	mu      sync.Mutex
+	loaders map[string]*loaderEntry[TRes]
+	// lru orders the entries of loaders from most to least recently used.
+	lru *list.List
+	// maxLoaders is the shard's share of cfg.maxLoaders, or 0 if loaders are not bounded.
+	maxLoaders int
+	closed     bool
+}
+
+// loaderEntry tracks a per-key SingleRequestDataLoader and how recently it was used.
+type loaderEntry[TRes any] struct {
+	key    string
+	loader *SingleRequestDataLoader[TRes]
+	elem   *list.Element
+	// active is the number of Loads currently using loader. Entries are only evicted while inactive.
+	// It is only incremented with the shard's lock held, but may be decremented without it.
+	active atomic.Int64
+	// lastUsed is the clock's time in Unix nanoseconds when a Load last stopped using loader.
+	lastUsed atomic.Int64
+}
+
+// newShards splits cfg.maxLoaders as evenly as possible between the shards.
+// There are never more shards than loaders, so that every shard can hold at least one.
+func newShards[TRes any](cfg config) []*shard[TRes] {
+	n := cfg.shards
+	if n <= 0 {
+		n = defaultShards
+	}
+	if cfg.maxLoaders > 0 {
+		n = min(n, cfg.maxLoaders)
+	}
+	shards := make([]*shard[TRes], n)
+	for i := range shards {
+		shards[i] = &shard[TRes]{
+			loaders: make(map[string]*loaderEntry[TRes]),
+			lru:     list.New(),
+		}
+		if cfg.maxLoaders > 0 {
+			shards[i].maxLoaders = cfg.maxLoaders / n
+			if i < cfg.maxLoaders%n {
+				shards[i].maxLoaders++
+			}
+		}
+	}
+	return shards
+}
+
+func (r *MultiRequestDataLoader[TArg, TRes]) shardFor(key string) *shard[TRes] {
+	if len(r.shards) == 1 {
+		return r.shards[0]
+	}
+	return r.shards[maphash.String(r.seed, key)%uint64(len(r.shards))]
+}
+
+// acquire returns the entry for key, creating its loader if needed, and marks it as in use.
+// It returns false if the loader has been closed.
+func (r *MultiRequestDataLoader[TArg, TRes]) acquire(s *shard[TRes], key string, arg TArg) (*loaderEntry[TRes], bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return r.acquireLocked(s, key, arg)
+}
+
+// acquireLocked is acquire with s.mu held.
+func (r *MultiRequestDataLoader[TArg, TRes]) acquireLocked(s *shard[TRes], key string, arg TArg) (*loaderEntry[TRes], bool) {
+	if s.closed {
+		return nil, false
+	}
+	entry, ok := s.loaders[key]
+	if !ok {
+		entry = &loaderEntry[TRes]{
+			key:    key,
+			loader: r.newKeyLoader(key, arg),
+		}
+		entry.elem = s.lru.PushFront(entry)
+		s.loaders[key] = entry
+	} else {
+		s.lru.MoveToFront(entry.elem)
+	}
+	entry.active.Add(1)
+	return entry, true
+}
+
+// release marks entry as no longer used by a Load, and evicts loaders that exceed the shard's max loader count.
+func (r *MultiRequestDataLoader[TArg, TRes]) release(s *shard[TRes], entry *loaderEntry[TRes]) {
+	// lastUsed is stored first, so that an idle sweep that sees the entry inactive also sees when it was last used.
+	entry.lastUsed.Store(r.cfg.clock.Now().UnixNano())
+	if s.maxLoaders <= 0 {
+		// Nothing is evicted by count, so a Load only takes the shard lock once, in acquire.
+		entry.active.Add(-1)
+		return
+	}
+	s.mu.Lock()
+	entry.active.Add(-1)
+	s.lru.MoveToFront(entry.elem)
+	evicted := s.evictLocked(r.cfg.observer)
+	s.mu.Unlock()
+
+	closeLoaders(evicted)
+}
+
+// evictLocked removes the least recently used inactive entries until at most s.maxLoaders remain.
+// Active entries are never evicted, so the count may exceed s.maxLoaders while they are in use.
+// s.mu must be held, and the returned loaders must be closed after it is released.
+func (s *shard[TRes]) evictLocked(observer Observer) []*SingleRequestDataLoader[TRes] {
+	if s.maxLoaders <= 0 {
+		return nil
+	}
+	var evicted []*SingleRequestDataLoader[TRes]
+	for elem := s.lru.Back(); elem != nil && len(s.loaders) > s.maxLoaders; {
+		entry := elem.Value.(*loaderEntry[TRes])
+		elem = elem.Prev()
+		if entry.active.Load() > 0 {
+			continue
+		}
+		evicted = append(evicted, s.removeLocked(entry))
+		observer.OnEvict(entry.key, EvictLRU)
+	}
+	return evicted
+}
+
+// sweepLocked removes the inactive entries that have not been used for idleTimeout.
+// s.mu must be held, and the returned loaders must be closed after it is released.
+func (s *shard[TRes]) sweepLocked(now time.Time, idleTimeout time.Duration, observer Observer) []*SingleRequestDataLoader[TRes] {
+	var evicted []*SingleRequestDataLoader[TRes]
+	for elem := s.lru.Back(); elem != nil; {
+		entry := elem.Value.(*loaderEntry[TRes])
+		elem = elem.Prev()
+		if entry.active.Load() == 0 && now.Sub(time.Unix(0, entry.lastUsed.Load())) >= idleTimeout {
+			evicted = append(evicted, s.removeLocked(entry))
+			observer.OnEvict(entry.key, EvictIdle)
+		}
+	}
+	return evicted
+}
+
+// closeLocked rejects new loads of the shard's keys, and removes every entry.
+// s.mu must be held, and the returned loaders must be closed after it is released.
+func (s *shard[TRes]) closeLocked() []*SingleRequestDataLoader[TRes] {
+	s.closed = true
+	loaders := make([]*SingleRequestDataLoader[TRes], 0, len(s.loaders))
+	for _, entry := range s.loaders {
+		loaders = append(loaders, s.removeLocked(entry))
+	}
+	return loaders
+}
+
+func (s *shard[TRes]) removeLocked(entry *loaderEntry[TRes]) *SingleRequestDataLoader[TRes] {
+	delete(s.loaders, entry.key)
+	s.lru.Remove(entry.elem)
+	return entry.loader
+}
+
+// sweepIdle periodically evicts loaders that have not been used for cfg.idleTimeout, until the loader is closed.
+func (r *MultiRequestDataLoader[TArg, TRes]) sweepIdle() {
+	defer r.sweepers.Done()
+
+	interval := r.cfg.idleTimeout / 2
+	timer := r.cfg.clock.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-timer.C():
+			for _, s := range r.shards {
+				s.mu.Lock()
+				evicted := s.sweepLocked(now, r.cfg.idleTimeout, r.cfg.observer)
+				s.mu.Unlock()
+
+				closeLoaders(evicted)
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// Len returns the number of per-key loaders that are currently running.
+func (r *MultiRequestDataLoader[TArg, TRes]) Len() int {
+	n := 0
+	for _, s := range r.shards {
+		s.mu.Lock()
+		n += len(s.loaders)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// closeLoaders closes evicted loaders, which are idle, so Close does not wait on them.
+func closeLoaders[TRes any](loaders []*SingleRequestDataLoader[TRes]) {
+	for _, loader := range loaders {
+		loader.Close(context.Background())
+	}
+}
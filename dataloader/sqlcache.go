@@ -0,0 +1,115 @@
+package dataloader
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// SQLCache is a Cache that persists entries in the dataloader_cache table of a SQLite database,
+// such as one opened with database.InitSQLiteDB after running the httpserver migrations.
+// Entries survive restarts, and can be shared by every loader in the process that uses the same namespace.
+// Negatively cached errors are stored as text, and are read back as a *CachedError.
+type SQLCache[TRes any] struct {
+	db        *sql.DB
+	namespace string
+	codec     Codec[TRes]
+}
+
+// NewSQLCache returns a SQLCache that stores entries of namespace in db, serialized with codec.
+func NewSQLCache[TRes any](db *sql.DB, namespace string, codec Codec[TRes]) *SQLCache[TRes] {
+	return &SQLCache[TRes]{
+		db:        db,
+		namespace: namespace,
+		codec:     codec,
+	}
+}
+
+func (c *SQLCache[TRes]) Get(ctx context.Context, key string) (CacheEntry[TRes], bool, error) {
+	var data []byte
+	var errMsg sql.NullString
+	var refreshAt, expiresAt int64
+	err := c.db.QueryRowContext(ctx,
+		`SELECT value, err, refresh_at, expires_at FROM dataloader_cache WHERE namespace = ? AND key = ?`,
+		c.namespace, key,
+	).Scan(&data, &errMsg, &refreshAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return CacheEntry[TRes]{}, false, nil
+	}
+	if err != nil {
+		return CacheEntry[TRes]{}, false, err
+	}
+
+	entry := CacheEntry[TRes]{
+		RefreshAt: fromUnixMilli(refreshAt),
+		ExpiresAt: fromUnixMilli(expiresAt),
+	}
+	if entry.expired(time.Now()) {
+		return CacheEntry[TRes]{}, false, nil
+	}
+	if errMsg.Valid {
+		entry.Err = &CachedError{Message: errMsg.String}
+		return entry, true, nil
+	}
+	entry.Value, err = c.codec.Unmarshal(data)
+	if err != nil {
+		return CacheEntry[TRes]{}, false, err
+	}
+	return entry, true, nil
+}
+
+func (c *SQLCache[TRes]) Set(ctx context.Context, key string, entry CacheEntry[TRes]) error {
+	var data []byte
+	var errMsg sql.NullString
+	if entry.Err != nil {
+		errMsg = sql.NullString{String: entry.Err.Error(), Valid: true}
+	} else {
+		var err error
+		data, err = c.codec.Marshal(entry.Value)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := c.db.ExecContext(ctx,
+		`INSERT INTO dataloader_cache (namespace, key, value, err, refresh_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (namespace, key) DO UPDATE SET
+			value = excluded.value, err = excluded.err, refresh_at = excluded.refresh_at, expires_at = excluded.expires_at`,
+		c.namespace, key, data, errMsg, toUnixMilli(entry.RefreshAt), toUnixMilli(entry.ExpiresAt),
+	)
+	return err
+}
+
+func (c *SQLCache[TRes]) Delete(ctx context.Context, key string) error {
+	_, err := c.db.ExecContext(ctx, `DELETE FROM dataloader_cache WHERE namespace = ? AND key = ?`, c.namespace, key)
+	return err
+}
+
+func (c *SQLCache[TRes]) Clear(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx, `DELETE FROM dataloader_cache WHERE namespace = ?`, c.namespace)
+	return err
+}
+
+// DeleteExpired removes the namespace's entries that have expired, which Get otherwise leaves in the table.
+func (c *SQLCache[TRes]) DeleteExpired(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx,
+		`DELETE FROM dataloader_cache WHERE namespace = ? AND expires_at != 0 AND expires_at <= ?`,
+		c.namespace, time.Now().UnixMilli(),
+	)
+	return err
+}
+
+// toUnixMilli stores the zero time as 0, meaning never.
+func toUnixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
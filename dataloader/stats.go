@@ -0,0 +1,66 @@
+package dataloader
+
+import "sync/atomic"
+
+// Stats is a snapshot of a data loader's counters, e.g. for exporting as metrics.
+type Stats struct {
+	// Calls is the number of loader calls issued, not counting retries and hedges.
+	Calls uint64
+	// Batches is the number of batch loader calls issued by a batching loader.
+	Batches uint64
+	// Coalesced is the number of loads that joined a loader call that was already in flight.
+	Coalesced uint64
+	// InFlight is the number of keys with a loader call in flight.
+	InFlight int64
+	// CacheHits is the number of loads served from the result cache.
+	CacheHits uint64
+	// CacheMisses is the number of loads that were not found in the result cache.
+	CacheMisses uint64
+	// Refreshes is the number of background reloads of cached results.
+	Refreshes uint64
+	// Errors is the number of loader calls that returned an error.
+	Errors uint64
+	// Retries is the number of loader calls that were retried after an error.
+	Retries uint64
+	// Hedges is the number of extra loader calls made because a call was slow to return.
+	Hedges uint64
+	// Forwards is the number of loader calls made by the peer owning the key, in place of this process.
+	Forwards uint64
+	// ForwardFailures is the number of loader calls that could not be forwarded, and were made locally instead.
+	ForwardFailures uint64
+}
+
+// stats holds the counters behind Stats. A MultiRequestDataLoader shares its stats with every per-key loader.
+type stats struct {
+	calls       atomic.Uint64
+	batches     atomic.Uint64
+	coalesced   atomic.Uint64
+	inFlight    atomic.Int64
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	refreshes   atomic.Uint64
+	errors      atomic.Uint64
+	retries     atomic.Uint64
+	hedges      atomic.Uint64
+
+	forwards        atomic.Uint64
+	forwardFailures atomic.Uint64
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Calls:       s.calls.Load(),
+		Batches:     s.batches.Load(),
+		Coalesced:   s.coalesced.Load(),
+		InFlight:    s.inFlight.Load(),
+		CacheHits:   s.cacheHits.Load(),
+		CacheMisses: s.cacheMisses.Load(),
+		Refreshes:   s.refreshes.Load(),
+		Errors:      s.errors.Load(),
+		Retries:     s.retries.Load(),
+		Hedges:      s.hedges.Load(),
+
+		Forwards:        s.forwards.Load(),
+		ForwardFailures: s.forwardFailures.Load(),
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeJSONError writes {"error": msg} with status.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": msg,
+	})
+}
+
+// getBlobByKey serves GET /cache/{key}.
+func getBlobByKey(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := loadBlob(r.Context(), db, "key", r.PathValue("key"))
+		serveBlob(w, r, b, err)
+	}
+}
+
+// getBlobByID serves GET /cache/id/{id}.
+func getBlobByID(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid id "+strconv.Quote(r.PathValue("id")))
+			return
+		}
+		b, err := loadBlob(r.Context(), db, "id", id)
+		serveBlob(w, r, b, err)
+	}
+}
+
+// serveBlob writes the data of b, or the error that loading it failed with.
+// It answers conditional requests against the blob's version and updated_at with 304 or 412,
+// and range requests with 206, or 416 if none of the ranges overlap the data.
+func serveBlob(w http.ResponseWriter, r *http.Request, b blob, err error) {
+	switch {
+	case errors.Is(err, errBlobNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	setBlobHeaders(w, b, b.Data)
+	http.ServeContent(w, r, b.Key, b.UpdatedAt, bytes.NewReader(b.Data))
+}
+
+// headBlob serves HEAD /cache/{key} from the metadata of the blob, without reading all of its data.
+// It answers with the same headers and status as GET would.
+func headBlob(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		b := blob{Key: key}
+		var size, createdAt, updatedAt int64
+		var head []byte
+		err := db.QueryRowContext(r.Context(),
+			`SELECT id, length(data), substr(data, 1, 512), content_type, version, created_at, updated_at
+			FROM blob_cache WHERE key = ?`,
+			key,
+		).Scan(&b.ID, &size, &head, &b.ContentType, &b.Version, &createdAt, &updatedAt)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			writeJSONError(w, http.StatusNotFound, "key "+key+": "+errBlobNotFound.Error())
+			return
+		case err != nil:
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		b.CreatedAt = time.Unix(createdAt, 0)
+		b.UpdatedAt = time.Unix(updatedAt, 0)
+
+		setBlobHeaders(w, b, head)
+		// ServeContent only needs the size of the data to answer a HEAD request.
+		http.ServeContent(w, r, key, b.UpdatedAt, io.NewSectionReader(unloadedData{}, 0, size))
+	}
+}
+
+// unloadedData stands in for the data of a blob that was not loaded.
+type unloadedData struct{}
+
+func (unloadedData) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("blob data is not loaded")
+}
+
+// setBlobHeaders sets the headers that describe b, besides those that http.ServeContent sets.
+// head is the start of the blob's data, to sniff its Content-Type from if none was stored.
+func setBlobHeaders(w http.ResponseWriter, b blob, head []byte) {
+	contentType := b.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(head)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", blobETag(b.Version))
+	w.Header().Set("Blob-Id", strconv.FormatInt(b.ID, 10))
+	w.Header().Set("Blob-Created-At", b.CreatedAt.UTC().Format(http.TimeFormat))
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// blobInfo describes a blob in the listing of GET /cache.
+type blobInfo struct {
+	Key       string    `json:"key"`
+	ID        int64     `json:"id"`
+	Size      int64     `json:"size"`
+	Version   int64     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// listCursor is where a page of GET /cache left off: the sort order and the sort values of the page's last blob.
+type listCursor struct {
+	Sort      string `json:"s"`
+	Key       string `json:"k,omitempty"`
+	UpdatedAt int64  `json:"u,omitempty"`
+	ID        int64  `json:"i,omitempty"`
+}
+
+// listBlobs serves GET /cache?prefix=...&sort=...&limit=...&cursor=..., which lists the blobs whose key starts with prefix,
+// without their data. sort is key (the default) or updated_at, prefixed with - for descending order.
+// Pages hold up to limit blobs, and next_cursor is set to the cursor of the next page while there is one.
+func listBlobs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		sort := query.Get("sort")
+		if sort == "" {
+			sort = "key"
+		}
+		field, desc := strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+		if field != "key" && field != "updated_at" {
+			writeJSONError(w, http.StatusBadRequest, "invalid sort "+strconv.Quote(sort)+": must be key or updated_at")
+			return
+		}
+
+		limit := defaultListLimit
+		if query.Has("limit") {
+			n, err := strconv.Atoi(query.Get("limit"))
+			if err != nil || n < 1 || n > maxListLimit {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %q: must be between 1 and %d", query.Get("limit"), maxListLimit))
+				return
+			}
+			limit = n
+		}
+
+		var where []string
+		var args []any
+		if query.Has("prefix") {
+			prefix := query.Get("prefix")
+			where = append(where, keyHasPrefix)
+			args = append(args, prefix, prefix)
+		}
+		cmp, order := ">", "ASC"
+		if desc {
+			cmp, order = "<", "DESC"
+		}
+		if query.Has("cursor") {
+			cursor, err := decodeCursor(query.Get("cursor"))
+			if err != nil || cursor.Sort != sort {
+				writeJSONError(w, http.StatusBadRequest, "invalid cursor "+strconv.Quote(query.Get("cursor")))
+				return
+			}
+			if field == "key" {
+				where = append(where, `key `+cmp+` ?`)
+				args = append(args, cursor.Key)
+			} else {
+				where = append(where, `(updated_at, id) `+cmp+` (?, ?)`)
+				args = append(args, cursor.UpdatedAt, cursor.ID)
+			}
+		}
+
+		stmt := `SELECT key, id, length(data), version, created_at, updated_at FROM blob_cache`
+		if len(where) > 0 {
+			stmt += ` WHERE ` + strings.Join(where, ` AND `)
+		}
+		if field == "key" {
+			stmt += ` ORDER BY key ` + order
+		} else {
+			stmt += ` ORDER BY updated_at ` + order + `, id ` + order
+		}
+		// Fetch one more blob than the page holds, to tell whether there is a next page.
+		stmt += ` LIMIT ?`
+		args = append(args, limit+1)
+
+		rows, err := db.QueryContext(r.Context(), stmt, args...)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer rows.Close()
+		blobs := []blobInfo{}
+		for rows.Next() {
+			var b blobInfo
+			var createdAt, updatedAt int64
+			if err := rows.Scan(&b.Key, &b.ID, &b.Size, &b.Version, &createdAt, &updatedAt); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			b.CreatedAt = time.Unix(createdAt, 0).UTC()
+			b.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+			blobs = append(blobs, b)
+		}
+		if err := rows.Err(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		res := map[string]any{
+			"blobs":       blobs,
+			"next_cursor": nil,
+		}
+		if len(blobs) > limit {
+			blobs = blobs[:limit]
+			last := blobs[limit-1]
+			res["blobs"] = blobs
+			res["next_cursor"] = encodeCursor(listCursor{Sort: sort, Key: last.Key, UpdatedAt: last.UpdatedAt.Unix(), ID: last.ID})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func encodeCursor(c listCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (listCursor, error) {
+	var c listCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// putBlob serves PUT /cache/{key}, which stores the request body under key, replacing any blob already stored there.
+// Each write gives the blob a new version, which is returned as its ETag.
+// Writers can make the write conditional with If-Match, so that it only replaces a version they have seen,
+// or with If-None-Match: *, so that it only creates a new blob. A failed condition answers 412.
+// An If-Match of * only replaces an existing blob.
+// A Cache-Tag header replaces the blob's tags with its comma-separated tags, for DELETE /cache?tag=...
+// Without one, the blob keeps its tags.
+func putBlob(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, err.Error())
+				return
+			}
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		key := r.PathValue("key")
+		contentType := storedContentType(r.Header.Get("Content-Type"))
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		var ifMatchVersions []int64
+		if ifMatch != "" && strings.TrimSpace(ifMatch) != "*" {
+			ifMatchVersions = parseETags(ifMatch)
+			if len(ifMatchVersions) == 0 {
+				writeJSONError(w, http.StatusPreconditionFailed, "If-Match does not match the version of "+strconv.Quote(key))
+				return
+			}
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer tx.Rollback()
+
+		// Take the next version first, so that the transaction holds the write lock for the rest of it.
+		version, err := nextBlobVersion(r.Context(), tx)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var exists bool
+		err = tx.QueryRowContext(r.Context(), `SELECT EXISTS (SELECT 1 FROM blob_cache WHERE key = ?)`, key).Scan(&exists)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		var query string
+		var args []any
+		switch {
+		case ifMatch != "":
+			query = `UPDATE blob_cache SET data = ?, content_type = ?, version = ?, updated_at = UNIXEPOCH()
+				WHERE key = ?`
+			args = []any{data, contentType, version, key}
+			if len(ifMatchVersions) > 0 {
+				query += ` AND version IN (` + placeholders(len(ifMatchVersions)) + `)`
+				for _, v := range ifMatchVersions {
+					args = append(args, v)
+				}
+			}
+		case strings.TrimSpace(ifNoneMatch) == "*":
+			query = `INSERT INTO blob_cache (key, data, content_type, version) VALUES (?, ?, ?, ?)
+				ON CONFLICT (key) DO NOTHING`
+			args = []any{key, data, contentType, version}
+		default:
+			// Any other If-None-Match lists versions that must not be replaced.
+			query = `INSERT INTO blob_cache (key, data, content_type, version) VALUES (?, ?, ?, ?)
+				ON CONFLICT (key) DO UPDATE SET data = excluded.data, content_type = excluded.content_type,
+					version = excluded.version, updated_at = UNIXEPOCH()`
+			args = []any{key, data, contentType, version}
+			if versions := parseETags(ifNoneMatch); len(versions) > 0 {
+				query += ` WHERE version NOT IN (` + placeholders(len(versions)) + `)`
+				for _, v := range versions {
+					args = append(args, v)
+				}
+			}
+		}
+		query += ` RETURNING id`
+
+		var id int64
+		err = tx.QueryRowContext(r.Context(), query, args...).Scan(&id)
+		switch {
+		case errors.Is(err, sql.ErrNoRows) && ifMatch != "":
+			writeJSONError(w, http.StatusPreconditionFailed, "If-Match does not match the version of "+strconv.Quote(key))
+			return
+		case errors.Is(err, sql.ErrNoRows):
+			writeJSONError(w, http.StatusPreconditionFailed, "If-None-Match matches the version of "+strconv.Quote(key))
+			return
+		case err != nil:
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if _, ok := r.Header["Cache-Tag"]; ok {
+			if err := setBlobTags(r.Context(), tx, id, parseTags(r.Header.Values("Cache-Tag"))); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", blobETag(version))
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":      id,
+			"version": version,
+		})
+	}
+}
+
+// nextBlobVersion returns a version that has never been given to a blob before, not even to one that was since deleted,
+// so that a blob's version, and so its ETag, never matches different data stored under the same key.
+func nextBlobVersion(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var version int64
+	err := tx.QueryRowContext(ctx, `UPDATE blob_cache_version SET version = version + 1 RETURNING version`).Scan(&version)
+	return version, err
+}
+
+// deleteBlob serves DELETE /cache/{key}, which answers 404 if there is no blob stored under key.
+// With If-Match, the blob is only deleted if it has one of the listed versions, and 412 is answered otherwise.
+func deleteBlob(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		query := `DELETE FROM blob_cache WHERE key = ?`
+		args := []any{key}
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch != "" && strings.TrimSpace(ifMatch) != "*" {
+			versions := parseETags(ifMatch)
+			if len(versions) == 0 {
+				writeJSONError(w, http.StatusPreconditionFailed, "If-Match does not match the version of "+strconv.Quote(key))
+				return
+			}
+			query += ` AND version IN (` + placeholders(len(versions)) + `)`
+			for _, v := range versions {
+				args = append(args, v)
+			}
+		}
+
+		res, err := db.ExecContext(r.Context(), query, args...)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		n, err := res.RowsAffected()
+		switch {
+		case err != nil:
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		case n == 0 && ifMatch != "":
+			writeJSONError(w, http.StatusPreconditionFailed, "If-Match does not match the version of "+strconv.Quote(key))
+			return
+		case n == 0:
+			writeJSONError(w, http.StatusNotFound, "key "+key+": "+errBlobNotFound.Error())
+			return
+		}
+		writeDeleted(w, n)
+	}
+}
+
+// deleteBlobs serves DELETE /cache?prefix=...&tag=..., which deletes every blob whose key starts with prefix
+// and which is tagged with tag. At least one of them is required, and neither may be empty,
+// so that the whole cache is not deleted by mistake.
+func deleteBlobs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if !query.Has("prefix") && !query.Has("tag") {
+			writeJSONError(w, http.StatusBadRequest, "prefix or tag is required")
+			return
+		}
+		for _, name := range []string{"prefix", "tag"} {
+			if query.Has(name) && query.Get(name) == "" {
+				writeJSONError(w, http.StatusBadRequest, name+" must not be empty")
+				return
+			}
+		}
+
+		var where []string
+		var args []any
+		if query.Has("prefix") {
+			prefix := query.Get("prefix")
+			where = append(where, keyHasPrefix)
+			args = append(args, prefix, prefix)
+		}
+		if query.Has("tag") {
+			where = append(where, `id IN (SELECT blob_id FROM blob_tags WHERE tag = ?)`)
+			args = append(args, query.Get("tag"))
+		}
+
+		res, err := db.ExecContext(r.Context(), `DELETE FROM blob_cache WHERE `+strings.Join(where, ` AND `), args...)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeDeleted(w, n)
+	}
+}
+
+// writeDeleted writes {"deleted": n}.
+func writeDeleted(w http.ResponseWriter, n int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"deleted": n,
+	})
+}
+
+// setBlobTags replaces the tags of the blob with id.
+func setBlobTags(ctx context.Context, tx *sql.Tx, id int64, tags []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blob_tags WHERE blob_id = ?`, id); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO blob_tags (blob_id, tag) VALUES (?, ?)`, id, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseTags returns the tags in the comma-separated lists of values, skipping empty ones.
+func parseTags(values []string) []string {
+	var tags []string
+	for _, v := range values {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// storedContentType returns the content_type to store for a blob uploaded with contentType.
+// Clients send application/octet-stream when they do not know the type, so leave it to be sniffed instead.
+func storedContentType(contentType string) string {
+	if contentType == "application/octet-stream" {
+		return ""
+	}
+	return contentType
+}
+
+// blobETag returns the ETag of version of a blob.
+func blobETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseETags returns the versions in a comma-separated list of ETags, such as an If-Match header.
+// Weak ETags and ETags that are not versions are skipped, since they never match.
+func parseETags(header string) []int64 {
+	var versions []int64
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		v, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// keyHasPrefix is an SQL condition that a blob's key starts with the prefix given twice as its args.
+// LIKE is case-insensitive, so it compares the start of the key instead.
+const keyHasPrefix = `substr(key, 1, length(?)) = ?`
+
+// placeholders returns n comma-separated SQL placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat(`?, `, n), `, `)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/httpserver/database"
+)
+
+// newTestServer serves the server's endpoints from a new database, migrated with the goose migrations.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newHandler(context.Background(), newTestDB(t)))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestDB opens a new database, migrated with the goose migrations.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	ctx := context.Background()
+	db, err := database.InitSQLiteDB(ctx, "file:"+filepath.Join(t.TempDir(), "db.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrations, err := filepath.Glob("migrations/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range migrations {
+		migration, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, _, _ := strings.Cut(string(migration), "-- +goose Down")
+		for _, stmt := range strings.Split(up, "-- +goose StatementBegin") {
+			stmt, _, _ = strings.Cut(stmt, "-- +goose StatementEnd")
+			if strings.Contains(stmt, "-- +goose") {
+				continue
+			}
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+		}
+	}
+
+	return db
+}
+
+// postBlob stores data under key with POST /cache, and returns its id.
+func postBlob(t *testing.T, srv *httptest.Server, key string, contentType string, data []byte) int64 {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+key+`"`)
+	header.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	resp, err := http.Post(srv.URL+"/cache", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return res.ID
+}
+
+func TestGetBlob(t *testing.T) {
+	srv := newTestServer(t)
+	png := []byte("\x89PNG\r\n\x1a\n0000")
+	id := postBlob(t, srv, "image", "application/octet-stream", png)
+	postBlob(t, srv, "notes.md", "text/markdown", []byte("# Notes"))
+
+	for _, tc := range []struct {
+		path        string
+		contentType string
+		body        []byte
+	}{
+		{"/cache/image", "image/png", png},
+		{"/cache/id/" + strconv.FormatInt(id, 10), "image/png", png},
+		{"/cache/notes.md", "text/markdown", []byte("# Notes")},
+	} {
+		resp, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, tc.body) {
+			t.Errorf("GET %s: expected %q, got %s %q", tc.path, tc.body, resp.Status, body)
+		}
+		if got := resp.Header.Get("Content-Type"); got != tc.contentType {
+			t.Errorf("GET %s: expected Content-Type %q, got %q", tc.path, tc.contentType, got)
+		}
+		if resp.ContentLength != int64(len(tc.body)) {
+			t.Errorf("GET %s: expected Content-Length %d, got %d", tc.path, len(tc.body), resp.ContentLength)
+		}
+		if _, err := http.ParseTime(resp.Header.Get("Last-Modified")); err != nil {
+			t.Errorf("GET %s: expected Last-Modified, got %v", tc.path, err)
+		}
+	}
+}
+
+func TestGetBlobNotFound(t *testing.T) {
+	srv := newTestServer(t)
+	for _, path := range []string{"/cache/missing", "/cache/id/42"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res struct {
+			Error string `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || err != nil || res.Error == "" {
+			t.Errorf("GET %s: expected a 404 JSON error, got %s, %+v, %v", path, resp.Status, res, err)
+		}
+	}
+}
+
+// put stores data under key with PUT /cache/{key} and the given conditional headers.
+func put(t *testing.T, srv *httptest.Server, key string, data string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/cache/"+key, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestPutBlob(t *testing.T) {
+	srv := newTestServer(t)
+
+	for i, tc := range []struct {
+		header http.Header
+		data   string
+		status int
+		etag   string
+	}{
+		{nil, "v1", http.StatusCreated, `"1"`},
+		{nil, "v2", http.StatusOK, `"2"`},
+		{http.Header{"If-Match": {`"1"`}}, "stale", http.StatusPreconditionFailed, ""},
+		{http.Header{"If-Match": {`"1", "2"`}}, "v3", http.StatusOK, `"3"`},
+		{http.Header{"If-Match": {`W/"3"`}}, "weak", http.StatusPreconditionFailed, ""},
+		{http.Header{"If-Match": {"*"}}, "v4", http.StatusOK, `"4"`},
+		{http.Header{"If-None-Match": {"*"}}, "create", http.StatusPreconditionFailed, ""},
+		{http.Header{"If-None-Match": {`"4"`}}, "unseen", http.StatusPreconditionFailed, ""},
+		{http.Header{"If-None-Match": {`"3"`}}, "v5", http.StatusOK, `"5"`},
+	} {
+		resp := put(t, srv, "key", tc.data, tc.header)
+		if resp.StatusCode != tc.status || resp.Header.Get("ETag") != tc.etag {
+			t.Errorf("%d: expected %d with ETag %s, got %s with ETag %s", i, tc.status, tc.etag, resp.Status, resp.Header.Get("ETag"))
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/cache/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "v5" || resp.Header.Get("ETag") != `"5"` {
+		t.Errorf(`expected "v5" with ETag "5", got %q with ETag %s`, body, resp.Header.Get("ETag"))
+	}
+}
+
+func TestPutBlobRecreated(t *testing.T) {
+	srv := newTestServer(t)
+	etag := put(t, srv, "key", "first", nil).Header.Get("ETag")
+	del(t, srv, "/cache/key", nil)
+	resp := put(t, srv, "key", "second", nil)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("ETag") == etag {
+		t.Fatalf("expected a re-created blob to get a new ETag, got %s with ETag %s", resp.Status, resp.Header.Get("ETag"))
+	}
+
+	if resp, body := get(t, srv, "/cache/key", http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusOK || string(body) != "second" {
+		t.Errorf("expected the ETag of the deleted blob not to match, got %s %q", resp.Status, body)
+	}
+	if resp := put(t, srv, "key", "third", http.Header{"If-Match": {etag}}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected If-Match with the ETag of the deleted blob to fail, got %s", resp.Status)
+	}
+}
+
+func TestPutBlobCreateOnly(t *testing.T) {
+	srv := newTestServer(t)
+	if resp := put(t, srv, "missing", "data", http.Header{"If-Match": {"*"}}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected If-Match: * to fail for a missing key, got %s", resp.Status)
+	}
+	if resp := put(t, srv, "new", "data", http.Header{"If-None-Match": {"*"}}); resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected If-None-Match: * to create a missing key, got %s", resp.Status)
+	}
+	if resp := put(t, srv, "new", "data", http.Header{"If-None-Match": {"*"}}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected If-None-Match: * to fail for an existing key, got %s", resp.Status)
+	}
+}
+
+// get fetches path with the given headers, and returns the response and its body.
+func get(t *testing.T, srv *httptest.Server, path string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestGetBlobConditional(t *testing.T) {
+	srv := newTestServer(t)
+	put(t, srv, "key", "v1", nil)
+	resp, _ := get(t, srv, "/cache/key", nil)
+	lastModified := resp.Header.Get("Last-Modified")
+	put(t, srv, "key", "v2", nil)
+
+	for _, tc := range []struct {
+		header http.Header
+		status int
+	}{
+		{http.Header{"If-None-Match": {`"2"`}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"1"`}}, http.StatusOK},
+		{http.Header{"If-None-Match": {`"1", W/"2"`}}, http.StatusNotModified},
+		{http.Header{"If-Modified-Since": {time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}}, http.StatusNotModified},
+		{http.Header{"If-Modified-Since": {time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)}}, http.StatusOK},
+		// If-None-Match takes precedence over If-Modified-Since.
+		{http.Header{"If-None-Match": {`"1"`}, "If-Modified-Since": {lastModified}}, http.StatusOK},
+		{http.Header{"If-Match": {`"1"`}}, http.StatusPreconditionFailed},
+	} {
+		resp, body := get(t, srv, "/cache/key", tc.header)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%v: expected %d, got %s", tc.header, tc.status, resp.Status)
+		}
+		if resp.StatusCode == http.StatusNotModified && (len(body) != 0 || resp.Header.Get("ETag") != `"2"`) {
+			t.Errorf("%v: expected no body with ETag \"2\", got %q with ETag %s", tc.header, body, resp.Header.Get("ETag"))
+		}
+	}
+}
+
+func TestGetBlobRange(t *testing.T) {
+	srv := newTestServer(t)
+	put(t, srv, "key", "0123456789", http.Header{"Content-Type": {"text/plain"}})
+
+	resp, body := get(t, srv, "/cache/key", http.Header{"Range": {"bytes=2-5"}})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "2345" || resp.Header.Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("expected 2345 for bytes 2-5/10, got %s %q for %s", resp.Status, body, resp.Header.Get("Content-Range"))
+	}
+
+	resp, body = get(t, srv, "/cache/key", http.Header{"Range": {"bytes=-3"}})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "789" {
+		t.Errorf("expected the last 3 bytes, got %s %q", resp.Status, body)
+	}
+
+	resp, body = get(t, srv, "/cache/key", http.Header{"Range": {"bytes=0-1,8-"}})
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusPartialContent || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected multipart/byteranges, got %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Range")+" "+string(data))
+	}
+	if want := []string{"bytes 0-1/10 01", "bytes 8-9/10 89"}; !slices.Equal(parts, want) {
+		t.Errorf("expected parts %q, got %q", want, parts)
+	}
+
+	resp, _ = get(t, srv, "/cache/key", http.Header{"Range": {"bytes=20-"}})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */10" {
+		t.Errorf("expected 416 for bytes */10, got %s for %s", resp.Status, resp.Header.Get("Content-Range"))
+	}
+
+	// A range is ignored once the blob has changed since the client's copy.
+	resp, body = get(t, srv, "/cache/key", http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"0"`}})
+	if resp.StatusCode != http.StatusOK || string(body) != "0123456789" {
+		t.Errorf("expected the whole blob for a stale If-Range, got %s %q", resp.Status, body)
+	}
+}
+
+// del sends a DELETE for path with the given headers, and returns the response and the number of blobs it deleted.
+func del(t *testing.T, srv *httptest.Server, path string, header http.Header) (*http.Response, int64) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodDelete, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Deleted int64 `json:"deleted"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return resp, res.Deleted
+}
+
+func TestDeleteBlob(t *testing.T) {
+	srv := newTestServer(t)
+	put(t, srv, "key", "v1", nil)
+	put(t, srv, "key", "v2", nil)
+
+	if resp, _ := del(t, srv, "/cache/key", http.Header{"If-Match": {`"1"`}}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected a stale If-Match to fail, got %s", resp.Status)
+	}
+	if resp, n := del(t, srv, "/cache/key", http.Header{"If-Match": {`"2"`}}); resp.StatusCode != http.StatusOK || n != 1 {
+		t.Errorf("expected 1 deleted, got %s with %d deleted", resp.Status, n)
+	}
+	if resp, _ := get(t, srv, "/cache/key", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the deleted blob to be missing, got %s", resp.Status)
+	}
+	if resp, _ := del(t, srv, "/cache/key", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected deleting a missing blob to answer 404, got %s", resp.Status)
+	}
+}
+
+func TestDeleteBlobs(t *testing.T) {
+	srv := newTestServer(t)
+	put(t, srv, "user:1:avatar", "a", http.Header{"Cache-Tag": {"user:1, avatars"}})
+	put(t, srv, "user:1:banner", "b", http.Header{"Cache-Tag": {"user:1"}})
+	put(t, srv, "user:2:avatar", "c", http.Header{"Cache-Tag": {"user:2", "avatars"}})
+	put(t, srv, "User:3:avatar", "d", http.Header{"Cache-Tag": {"avatars"}})
+	put(t, srv, "user_3", "e", nil)
+	// Tags are replaced by a Cache-Tag header, and kept without one.
+	put(t, srv, "user:1:banner", "b2", http.Header{"Cache-Tag": {"banners"}})
+	put(t, srv, "user:1:banner", "b3", nil)
+
+	for _, query := range []string{"", "?prefix=", "?tag=", "?prefix=&tag=avatars", "?prefix=user:&tag="} {
+		if resp, _ := del(t, srv, "/cache"+query, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected deleting without a prefix or tag to answer 400, got %s", query, resp.Status)
+		}
+	}
+
+	for _, tc := range []struct {
+		query   string
+		deleted int64
+	}{
+		{"tag=user:1", 1},
+		{"tag=user:1", 0},
+		{"tag=banners", 1},
+		{"prefix=user:&tag=avatars", 1},
+		{"prefix=user%25", 0},
+		{"tag=avatars", 1},
+		{"prefix=user_", 1},
+	} {
+		resp, n := del(t, srv, "/cache?"+tc.query, nil)
+		if resp.StatusCode != http.StatusOK || n != tc.deleted {
+			t.Errorf("%s: expected %d deleted, got %s with %d deleted", tc.query, tc.deleted, resp.Status, n)
+		}
+	}
+}
+
+// list fetches every page of GET /cache with query and the given page size, and returns the keys listed.
+func list(t *testing.T, srv *httptest.Server, query string, limit int) []string {
+	t.Helper()
+	var keys []string
+	cursor := ""
+	for {
+		path := "/cache?" + query + "&limit=" + strconv.Itoa(limit)
+		if cursor != "" {
+			path += "&cursor=" + cursor
+		}
+		resp, body := get(t, srv, path, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s %s", path, resp.Status, body)
+		}
+		var res struct {
+			Blobs []struct {
+				Key       string    `json:"key"`
+				ID        int64     `json:"id"`
+				Size      int64     `json:"size"`
+				Version   int64     `json:"version"`
+				CreatedAt time.Time `json:"created_at"`
+				UpdatedAt time.Time `json:"updated_at"`
+			} `json:"blobs"`
+			NextCursor *string `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Blobs) > limit {
+			t.Fatalf("GET %s: expected at most %d blobs, got %d", path, limit, len(res.Blobs))
+		}
+		for _, b := range res.Blobs {
+			if b.ID == 0 || b.Size != int64(len(b.Key)) || b.Version == 0 || b.CreatedAt.IsZero() || b.UpdatedAt.IsZero() {
+				t.Errorf("GET %s: unexpected metadata %+v", path, b)
+			}
+			keys = append(keys, b.Key)
+		}
+		if res.NextCursor == nil {
+			return keys
+		}
+		cursor = *res.NextCursor
+	}
+}
+
+func TestListBlobs(t *testing.T) {
+	srv := newTestServer(t)
+	for _, key := range []string{"b:2", "a:1", "b:1", "c", "b:3"} {
+		// Each blob's data is its key, to check the listed sizes.
+		put(t, srv, key, key, nil)
+	}
+
+	for _, tc := range []struct {
+		query string
+		limit int
+		keys  []string
+	}{
+		{"", 2, []string{"a:1", "b:1", "b:2", "b:3", "c"}},
+		{"sort=-key", 3, []string{"c", "b:3", "b:2", "b:1", "a:1"}},
+		{"prefix=b:", 2, []string{"b:1", "b:2", "b:3"}},
+		{"prefix=b:", 3, []string{"b:1", "b:2", "b:3"}},
+		{"prefix=B:", 1, nil},
+		// Blobs updated within the same second are ordered by id, so they are listed in the order that they were written.
+		{"sort=updated_at", 2, []string{"b:2", "a:1", "b:1", "c", "b:3"}},
+		{"sort=-updated_at&prefix=b:", 1, []string{"b:3", "b:1", "b:2"}},
+	} {
+		if keys := list(t, srv, tc.query, tc.limit); !slices.Equal(keys, tc.keys) {
+			t.Errorf("%s: expected %q, got %q", tc.query, tc.keys, keys)
+		}
+	}
+
+	for _, query := range []string{"sort=size", "limit=0", "limit=1001", "cursor=nope", "sort=key&cursor=" + encodeCursor(listCursor{Sort: "updated_at"})} {
+		if resp, _ := get(t, srv, "/cache?"+query, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %s", query, resp.Status)
+		}
+	}
+}
+
+func TestHeadBlob(t *testing.T) {
+	srv := newTestServer(t)
+	put(t, srv, "key", "<html>hello</html>", nil)
+	put(t, srv, "key", "<html>hello again</html>", nil)
+
+	head := func(header http.Header) *http.Response {
+		req, err := http.NewRequest(http.MethodHead, srv.URL+"/cache/key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	want, _ := get(t, srv, "/cache/key", nil)
+	resp := head(http.Header{})
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len("<html>hello again</html>")) {
+		t.Errorf("expected 200 with the length of the data, got %s with %d", resp.Status, resp.ContentLength)
+	}
+	for _, name := range []string{"Content-Type", "ETag", "Last-Modified", "Blob-Id", "Blob-Created-At"} {
+		if got := resp.Header.Get(name); got == "" || got != want.Header.Get(name) {
+			t.Errorf("expected %s %q as for GET, got %q", name, want.Header.Get(name), got)
+		}
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("expected the sniffed Content-Type, got %q", got)
+	}
+
+	if resp := head(http.Header{"If-None-Match": {`"2"`}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304, got %s", resp.Status)
+	}
+	if resp := head(http.Header{"Range": {"bytes=0-1,3-4"}}); resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("expected 206, got %s", resp.Status)
+	}
+
+	req, _ := http.NewRequest(http.MethodHead, srv.URL+"/cache/missing", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing key, got %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blob is a row of the blob_cache table.
+type blob struct {
+	ID   int64
+	Key  string
+	Data []byte
+	// ContentType is empty if the type of Data was not given when it was stored.
+	ContentType string
+	// Version changes with every write, and is never given to another blob, so it identifies the blob's data.
+	Version   int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// loadBlob loads the blob whose column is key, or fails with errBlobNotFound.
+func loadBlob(ctx context.Context, db *sql.DB, column string, key any) (blob, error) {
+	var b blob
+	var createdAt, updatedAt int64
+	err := db.QueryRowContext(ctx,
+		`SELECT id, key, data, content_type, version, created_at, updated_at FROM blob_cache WHERE `+column+` = ?`,
+		key,
+	).Scan(&b.ID, &b.Key, &b.Data, &b.ContentType, &b.Version, &createdAt, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return blob{}, fmt.Errorf("%s %v: %w", column, key, errBlobNotFound)
+	}
+	if err != nil {
+		return blob{}, err
+	}
+	b.CreatedAt = time.Unix(createdAt, 0)
+	b.UpdatedAt = time.Unix(updatedAt, 0)
+	return b, nil
+}
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS dataloader_cache
+(
+    namespace  TEXT    NOT NULL,
+    key        TEXT    NOT NULL,
+    value      BLOB,
+    err        TEXT,
+    -- Unix milliseconds, or 0 for never.
+    refresh_at INTEGER NOT NULL DEFAULT 0,
+    expires_at INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (namespace, key)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS dataloader_cache;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The Content-Type of the uploaded file, or '' to sniff it from the data.
+ALTER TABLE blob_cache ADD COLUMN content_type TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE blob_cache DROP COLUMN content_type;
+-- +goose StatementEnd
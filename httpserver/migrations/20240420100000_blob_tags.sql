@@ -0,0 +1,32 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS blob_tags
+(
+    blob_id INTEGER NOT NULL REFERENCES blob_cache (id),
+    tag     TEXT    NOT NULL,
+    PRIMARY KEY (tag, blob_id)
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS blob_tags_blob_id ON blob_tags (blob_id);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Foreign keys are not enforced, so remove the tags of a deleted blob here instead of with ON DELETE CASCADE.
+CREATE TRIGGER IF NOT EXISTS blob_cache_delete_tags
+    AFTER DELETE
+    ON blob_cache
+BEGIN
+    DELETE FROM blob_tags WHERE blob_id = OLD.id;
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS blob_cache_delete_tags;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE IF EXISTS blob_tags;
+-- +goose StatementEnd
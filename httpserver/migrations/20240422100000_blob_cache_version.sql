@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The last version given to a blob. Versions are never reused, not even by a blob that is deleted and created again,
+-- so that a blob's ETag never matches different data stored under the same key.
+CREATE TABLE IF NOT EXISTS blob_cache_version
+(
+    id      INTEGER PRIMARY KEY CHECK (id = 1),
+    version INTEGER NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+INSERT INTO blob_cache_version (id, version)
+SELECT 1, COALESCE(MAX(version), 0)
+FROM blob_cache;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS blob_cache_version;
+-- +goose StatementEnd
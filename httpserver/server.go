@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/joshchoo/go-sandbox/httpserver/database"
@@ -36,6 +37,30 @@ func run(ctx context.Context) error {
 		return err
 	}
 
+	s := http.Server{
+		Addr:    "localhost:8000",
+		Handler: newHandler(ctx, db),
+	}
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			slog.Error(err.Error())
+		}
+	}()
+
+	<-ctx.Done()
+	slog.InfoContext(ctx, "Exit signal received. Shutting down server.")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newHandler routes the server's endpoints. ctx is the context of the server.
+func newHandler(ctx context.Context, db *sql.DB) http.Handler {
 	h := http.NewServeMux()
 
 	h.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
@@ -61,7 +86,18 @@ func run(ctx context.Context) error {
 			return
 		}
 
-		res, err := db.ExecContext(ctx, `INSERT INTO blob_cache (key, data) VALUES (?, ?)`, header.Filename, fileBytes)
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		version, err := nextBlobVersion(ctx, tx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO blob_cache (key, data, content_type, version) VALUES (?, ?, ?, ?)`, header.Filename, fileBytes, storedContentType(header.Header.Get("Content-Type")), version)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -71,6 +107,10 @@ func run(ctx context.Context) error {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		err = json.NewEncoder(w).Encode(map[string]any{
@@ -82,24 +122,19 @@ func run(ctx context.Context) error {
 		}
 	}), maxCacheSizeBytes))
 
-	s := http.Server{
-		Addr:    "localhost:8000",
-		Handler: h,
-	}
+	h.HandleFunc("GET /cache", listBlobs(db))
 
-	go func() {
-		if err := s.ListenAndServe(); err != nil {
-			slog.Error(err.Error())
-		}
-	}()
+	h.HandleFunc("GET /cache/{key}", getBlobByKey(db))
 
-	<-ctx.Done()
-	slog.InfoContext(ctx, "Exit signal received. Shutting down server.")
+	h.HandleFunc("HEAD /cache/{key}", headBlob(db))
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := s.Shutdown(shutdownCtx); err != nil {
-		return err
-	}
-	return nil
+	h.HandleFunc("GET /cache/id/{id}", getBlobByID(db))
+
+	h.Handle("PUT /cache/{key}", http.MaxBytesHandler(putBlob(db), maxCacheSizeBytes))
+
+	h.HandleFunc("DELETE /cache/{key}", deleteBlob(db))
+
+	h.HandleFunc("DELETE /cache", deleteBlobs(db))
+
+	return h
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/joshchoo/go-sandbox/dataloader"
+)
+
+type userID int64
+
+func (id userID) Arg() int64 {
+	return int64(id)
+}
+
+func (id userID) Key() string {
+	return fmt.Sprint(int64(id))
+}
+
+type user struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+var errUserNotFound = errors.New("user not found")
+
+// newUserLoader creates a loader that caches users in cache, and counts its calls.
+func newUserLoader(cache *dataloader.SQLCache[user], calls *atomic.Int64) *dataloader.MultiRequestDataLoader[int64, user] {
+	return dataloader.NewMultiRequestDataLoader(func(ctx context.Context, id int64) (user, error) {
+		calls.Add(1)
+		if id < 0 {
+			return user{}, fmt.Errorf("user %d: %w", id, errUserNotFound)
+		}
+		return user{ID: id, Name: fmt.Sprintf("user %d", id)}, nil
+	},
+		dataloader.WithCache(time.Minute),
+		dataloader.WithNegativeCache(time.Minute, errUserNotFound),
+		dataloader.WithCacheBackend[user](cache),
+	)
+}
+
+func TestSQLCache(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	cache := dataloader.NewSQLCache[user](db, "users", dataloader.JSONCodec[user]{})
+
+	var calls atomic.Int64
+	loader := newUserLoader(cache, &calls)
+	if _, err := loader.Load(ctx, userID(1)); err != nil {
+		t.Fatal(err)
+	}
+	loader.Load(ctx, userID(-1))
+	loader.Close(ctx)
+
+	// A new loader, as after a restart, reads back what the first one stored.
+	loader = newUserLoader(cache, &calls)
+	defer loader.Close(ctx)
+	res, err := loader.Load(ctx, userID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := (user{ID: 1, Name: "user 1"}); res != exp || calls.Load() != 2 {
+		t.Errorf("expected the stored %+v without calling the loader, got %+v after %d calls", exp, res, calls.Load())
+	}
+	_, err = loader.Load(ctx, userID(-1))
+	var cachedErr *dataloader.CachedError
+	if !errors.As(err, &cachedErr) || !errors.Is(err, errUserNotFound) || calls.Load() != 2 {
+		t.Errorf("expected the stored not found error, got %v after %d calls", err, calls.Load())
+	}
+
+	// Namespaces keep their entries apart.
+	other := newUserLoader(dataloader.NewSQLCache[user](db, "other", dataloader.JSONCodec[user]{}), &calls)
+	defer other.Close(ctx)
+	other.Load(ctx, userID(1))
+	if calls.Load() != 3 {
+		t.Errorf("expected another namespace not to share entries, got %d calls", calls.Load())
+	}
+
+	loader.Clear("1")
+	loader.Load(ctx, userID(1))
+	if calls.Load() != 4 {
+		t.Errorf("expected a cleared entry to be reloaded, got %d calls", calls.Load())
+	}
+	loader.ClearAll()
+	loader.Load(ctx, userID(-1))
+	other.Load(ctx, userID(1))
+	if calls.Load() != 5 {
+		t.Errorf("expected ClearAll to clear only its namespace, got %d calls", calls.Load())
+	}
+}
+
+func TestSQLCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	cache := dataloader.NewSQLCache[user](db, "users", dataloader.JSONCodec[user]{})
+
+	now := time.Now()
+	cache.Set(ctx, "expired", dataloader.CacheEntry[user]{Value: user{ID: 1}, ExpiresAt: now.Add(-time.Second)})
+	cache.Set(ctx, "live", dataloader.CacheEntry[user]{Value: user{ID: 2}, ExpiresAt: now.Add(time.Minute), RefreshAt: now.Add(time.Second)})
+	cache.Set(ctx, "forever", dataloader.CacheEntry[user]{Value: user{ID: 3}})
+
+	if _, ok, err := cache.Get(ctx, "expired"); ok || err != nil {
+		t.Errorf("expected an expired entry to be missing, got %v, %v", ok, err)
+	}
+	entry, ok, err := cache.Get(ctx, "live")
+	if !ok || err != nil || entry.Value.ID != 2 || !entry.RefreshAt.Equal(now.Add(time.Second).Truncate(time.Millisecond)) {
+		t.Errorf("expected the live entry with its refresh time, got %+v, %v, %v", entry, ok, err)
+	}
+	entry, ok, err = cache.Get(ctx, "forever")
+	if !ok || err != nil || !entry.ExpiresAt.IsZero() || !entry.RefreshAt.IsZero() {
+		t.Errorf("expected an entry that never expires, got %+v, %v, %v", entry, ok, err)
+	}
+
+	if err := cache.DeleteExpired(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM dataloader_cache`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected DeleteExpired to leave the 2 live entries, got %d", n)
+	}
+}
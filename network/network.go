@@ -7,6 +7,8 @@ import (
 	"log"
 	"net"
 	"time"
+
+	"github.com/joshchoo/go-sandbox/clock"
 )
 
 func AvailablePort() (int, func(), error) {
@@ -27,6 +29,11 @@ func AvailablePort() (int, func(), error) {
 const defaultPingInterval = 30 * time.Second
 
 func Pinger(ctx context.Context, w io.Writer, resetTimerIntervalCh <-chan time.Duration) {
+	PingerWithClock(ctx, clock.Real(), w, resetTimerIntervalCh)
+}
+
+// PingerWithClock is Pinger, with its timer driven by clk.
+func PingerWithClock(ctx context.Context, clk clock.Clock, w io.Writer, resetTimerIntervalCh <-chan time.Duration) {
 	interval := defaultPingInterval
 	setInterval := func(i time.Duration) {
 		switch {
@@ -37,10 +44,10 @@ func Pinger(ctx context.Context, w io.Writer, resetTimerIntervalCh <-chan time.D
 		}
 	}
 
-	timer := time.NewTimer(interval)
+	timer := clk.NewTimer(interval)
 	stopTimerAndDrain := func() {
 		if !timer.Stop() {
-			<-timer.C
+			<-timer.C()
 		}
 	}
 	defer stopTimerAndDrain()
@@ -61,7 +68,7 @@ func Pinger(ctx context.Context, w io.Writer, resetTimerIntervalCh <-chan time.D
 			stopTimerAndDrain()
 			setInterval(newInterval)
 			log.Printf("[Pinger] Updated interval to %v\n", interval)
-		case <-timer.C: // send "ping" when timer expires
+		case <-timer.C(): // send "ping" when timer expires
 			log.Println("[Pinger] Sending ping")
 			if _, err := sendPing(); err != nil {
 				return
@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/joshchoo/go-sandbox/clock"
 	"github.com/joshchoo/go-sandbox/network"
 )
 
@@ -190,14 +191,46 @@ func TestDialContextCanceled(t *testing.T) {
 	}
 }
 
+// resetClock is a Fake clock whose NewTimer timers send every duration they are Reset to on resets,
+// so that a test can wait for Pinger to arm its timer with the interval it expects.
+type resetClock struct {
+	*clock.Fake
+	resets chan time.Duration
+}
+
+func (c resetClock) NewTimer(d time.Duration) clock.Timer {
+	return resetTimer{Timer: c.Fake.NewTimer(d), resets: c.resets}
+}
+
+type resetTimer struct {
+	clock.Timer
+	resets chan time.Duration
+}
+
+func (t resetTimer) Reset(d time.Duration) bool {
+	active := t.Timer.Reset(d)
+	t.resets <- d
+	return active
+}
+
 func TestPingerAdvanceDeadline(t *testing.T) {
 	listener, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	startTime := time.Now()
+	clk := resetClock{Fake: clock.NewFake(time.Now()), resets: make(chan time.Duration, 16)}
+	// waitForReset waits for Pinger to rearm its timer, and checks that it did so with interval.
+	waitForReset := func(interval time.Duration) {
+		t.Helper()
+		if d := <-clk.resets; d != interval {
+			t.Fatalf("Expected Pinger to rearm its timer with %s, got %s", interval, d)
+		}
+	}
+	startTime := clk.Now()
 	done := make(chan struct{})
+	ponged := make(chan struct{})
+	var end time.Duration
 
 	// This goroutines simulates a server periodically pinging the client and checking for a heartbeat ("pong").
 	// The server expects to receive a "pong" from the client at least once every five seconds to confirm that the client is still alive.
@@ -210,10 +243,17 @@ func TestPingerAdvanceDeadline(t *testing.T) {
 				log.Println("Network connection already closed. Returning.")
 				return
 			}
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 		defer conn.Close()
 
+		// The heartbeat deadline stands in for the connection's read deadline, which only follows the real clock.
+		// Closing the connection fails the pending read, just as exceeding the deadline would.
+		heartbeat := clk.AfterFunc(5*time.Second, func() {
+			conn.Close()
+		})
+
 		// Send a ping every second
 		ctx, cancel := context.WithCancel(context.Background())
 		defer func() {
@@ -222,31 +262,25 @@ func TestPingerAdvanceDeadline(t *testing.T) {
 		resetTimerIntervalCh := make(chan time.Duration, 1)
 		resetTimerIntervalCh <- 1 * time.Second
 		// Ping the client at each time interval
-		go network.Pinger(ctx, conn, resetTimerIntervalCh)
+		go network.PingerWithClock(ctx, clk, conn, resetTimerIntervalCh)
 
 		// Continuously read from connection
 		buf := make([]byte, 1024)
 		for {
-			// Update the connection's read and write deadlines
-			err = conn.SetDeadline(time.Now().Add(5 * time.Second))
-			if err != nil {
-				t.Error(err)
-				return
-			}
-
 			n, err := conn.Read(buf)
-			// error may occur due to connection timeout, disconnect, io.EOF, etc
+			// error may occur due to heartbeat timeout, disconnect, io.EOF, etc
 			if err != nil {
-				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
-					t.Logf("[server: %s] Read deadline timeout exceeded. Exiting.", time.Since(startTime).Truncate(time.Second))
-					return
-				}
-				t.Error(err)
+				end = clk.Now().Sub(startTime)
+				t.Logf("[server: %s] Heartbeat deadline exceeded. Exiting.", end)
+				return
 			}
-			t.Logf("[server: %s] Got: %s", time.Since(startTime).Truncate(time.Second), buf[:n])
+			t.Logf("[server: %s] Got: %s", clk.Now().Sub(startTime), buf[:n])
 
-			// now reset the Pinger's timer to the default interval (30 seconds) so that we can trigger a read deadline exceeded.
+			// Advance the heartbeat deadline
+			heartbeat.Reset(5 * time.Second)
+			// now reset the Pinger's timer to the default interval (30 seconds) so that we can trigger a heartbeat timeout.
 			resetTimerIntervalCh <- 0
+			ponged <- struct{}{}
 		}
 	}()
 
@@ -258,24 +292,33 @@ func TestPingerAdvanceDeadline(t *testing.T) {
 	defer conn.Close()
 
 	// Receive 4 pings from the server. One ping per second.
-	// The total wait time of 4 seconds is still within the server's read deadline of 5 seconds.
+	// The total wait time of 4 seconds is still within the server's heartbeat deadline of 5 seconds.
 	// Then send a "pong" to the server.
 	buf := make([]byte, 1024)
 	for i := 0; i < 4; i++ {
+		// Wait for the Pinger's timer to be armed with the 1 second interval, first when the interval is
+		// applied and then after each ping, and for the heartbeat, before advancing the clock.
+		waitForReset(time.Second)
+		clk.BlockUntil(2)
+		clk.Advance(time.Second)
 		n, err := conn.Read(buf)
 		if err != nil {
 			t.Fatal(err)
 		}
-		t.Logf("[client: %s] Got: %s", time.Since(startTime).Truncate(time.Second), buf[:n])
+		t.Logf("[client: %s] Got: %s", clk.Now().Sub(startTime), buf[:n])
 	}
+	waitForReset(time.Second)
 	_, err = conn.Write([]byte("pong"))
 	if err != nil {
 		t.Fatal(err)
 	}
+	<-ponged
+	waitForReset(30 * time.Second)
 
 	// After the server received the "pong", the Ping interval changes to 30 seconds.
-	// The server's read deadline will exceed before the first loop even completes,
+	// The server's heartbeat deadline will exceed before the next ping,
 	// and the client receives io.EOF.
+	clk.Advance(5 * time.Second)
 	for i := 0; i < 4; i++ {
 		n, err := conn.Read(buf)
 		if err != nil {
@@ -285,14 +328,13 @@ func TestPingerAdvanceDeadline(t *testing.T) {
 			t.Logf("[client] Received EOF")
 			break
 		}
-		t.Logf("[client: %s] Got: %s", time.Since(startTime).Truncate(time.Second), buf[:n])
+		t.Logf("[client: %s] Got: %s", clk.Now().Sub(startTime), buf[:n])
 	}
 
-	// The server's read deadline will exceed 5 seconds, and return an error on conn.Read().
+	// The server's heartbeat deadline will exceed 5 seconds after the "pong", and fail its conn.Read().
 	// Then it will close the `done` channel. Wait for the channel to close.
 	<-done
 
-	end := time.Since(startTime).Truncate(time.Second)
 	t.Logf("[%s] done", end)
 	if end != 9*time.Second {
 		t.Fatalf("Expected EOF at 9 seconds, got %s", end)